@@ -0,0 +1,139 @@
+//  Copyright 2014-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package go_n1ql
+
+import (
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"github.com/couchbase/go-couchbase"
+)
+
+// ConsistentWith collects the writes a query has to see, so that it can be
+// run with at_plus scan consistency: indexes are scanned once they include
+// those writes, rather than all the writes made before the query as with
+// request_plus. Set it in QueryOptions. The zero value is ready to use, and
+// it is safe for concurrent use.
+//
+// Writes made through go-couchbase are added with the mutation tokens they
+// return, see couchbase.Bucket.WriteWithMT. The query service does not
+// return mutation tokens for DML statements, so once an INSERT, UPSERT,
+// UPDATE, DELETE or MERGE statement has been sent with it, the requests
+// using it fall back to request_plus until Reset is called. Statements are
+// only left out if their whole response was read and reported that no
+// document changed.
+type ConsistentWith struct {
+	lock        sync.Mutex
+	tokens      map[string]map[uint16]couchbase.MutationToken
+	requestPlus bool
+
+	// DML statements sent whose outcome is not known yet
+	running int
+}
+
+// Add the mutation tokens of writes to the given bucket. Nil tokens, which
+// buckets not supporting them return, are ignored.
+func (c *ConsistentWith) Add(bucket string, tokens ...*couchbase.MutationToken) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.tokens == nil {
+		c.tokens = make(map[string]map[uint16]couchbase.MutationToken)
+	}
+	vbuckets := c.tokens[bucket]
+	if vbuckets == nil {
+		vbuckets = make(map[uint16]couchbase.MutationToken)
+		c.tokens[bucket] = vbuckets
+	}
+
+	for _, token := range tokens {
+		if token == nil {
+			continue
+		}
+
+		// a different guard means the vbucket failed over since, the
+		// token added last is the one to wait for
+		if known, ok := vbuckets[token.VBid]; ok && known.Guard == token.Guard && known.Value >= token.Value {
+			continue
+		}
+		vbuckets[token.VBid] = *token
+	}
+}
+
+// Reset forgets the writes collected so far
+func (c *ConsistentWith) Reset() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.tokens = nil
+	c.requestPlus = false
+}
+
+// a statement that may change documents is sent
+func (c *ConsistentWith) mutating() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.running++
+}
+
+// a statement sent after mutating has completed, changed is false only if
+// its response proved that no document changed
+func (c *ConsistentWith) mutated(changed bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.running > 0 {
+		c.running--
+	}
+	if changed {
+		c.requestPlus = true
+	}
+}
+
+// Set the scan consistency needed to see the writes, if any. Scan vectors
+// map each bucket to the sequence number and UUID of its vbuckets.
+func (c *ConsistentWith) setValues(v *url.Values) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.requestPlus || c.running > 0 {
+		v.Set("scan_consistency", string(RequestPlus))
+		v.Del("scan_vectors")
+		return nil
+	}
+	if len(c.tokens) == 0 {
+		return nil
+	}
+
+	vectors := make(map[string]map[string][2]interface{}, len(c.tokens))
+	for bucket, vbuckets := range c.tokens {
+		vector := make(map[string][2]interface{}, len(vbuckets))
+		for vbid, token := range vbuckets {
+			vector[strconv.Itoa(int(vbid))] = [2]interface{}{token.Value, strconv.FormatUint(token.Guard, 10)}
+		}
+		vectors[bucket] = vector
+	}
+
+	bytes, err := json.Marshal(vectors)
+	if err != nil {
+		return err
+	}
+	v.Set("scan_consistency", string(AtPlus))
+	v.Set("scan_vectors", string(bytes))
+	return nil
+}
+
+// whether statement may write to the data
+func isMutation(statement string) bool {
+	switch statementKeyword(statement) {
+	case "INSERT", "UPSERT", "UPDATE", "DELETE", "MERGE":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,151 @@
+//  Copyright 2014-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package go_n1ql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/couchbase/go-couchbase"
+)
+
+func TestConsistentWith(t *testing.T) {
+	var form url.Values
+	srv := fakeQueryService(t, func(r *http.Request) string {
+		form = r.Form
+		switch r.Form.Get("statement") {
+		case "insert into b values ('k', {})":
+			return `{"results": [], "status": "success", "metrics": {"mutationCount": 1}}`
+		case "insert into b values ('x', {})":
+			return `{"results": [], "errors": [{"code": 12009, "msg": "Duplicate Key"}], "status": "errors", "metrics": {"errorCount": 1}}`
+		case "update b set x = 1 returning meta().id":
+			return `{"signature": {"id": "json"}, "results": [{"id": "k"}, {"id": "l"}], "status": "success", "metrics": {"mutationCount": 2}}`
+		}
+		return `{"signature": {"id": "number"}, "results": [{"id": 1}], "status": "success"}`
+	})
+	defer srv.Close()
+
+	connector, err := NewConnector(Config{Endpoint: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	query := func(ctx context.Context) {
+		var id int
+		if err := db.QueryRowContext(ctx, "select id from b").Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cw := &ConsistentWith{}
+	ctx := WithQueryOptions(context.Background(), QueryOptions{ConsistentWith: cw})
+
+	// nothing written yet
+	query(ctx)
+	if form.Get("scan_consistency") != "" || form.Get("scan_vectors") != "" {
+		t.Fatalf("Unexpected consistency %q %q", form.Get("scan_consistency"), form.Get("scan_vectors"))
+	}
+
+	// the latest token of each vbucket is waited for
+	cw.Add("b", &couchbase.MutationToken{VBid: 12, Guard: 1234, Value: 5}, nil)
+	cw.Add("b", &couchbase.MutationToken{VBid: 12, Guard: 1234, Value: 3},
+		&couchbase.MutationToken{VBid: 40, Guard: 99, Value: 7})
+	query(ctx)
+	if form.Get("scan_consistency") != "at_plus" {
+		t.Fatalf("Expected at_plus got %q", form.Get("scan_consistency"))
+	}
+	var vectors map[string]map[string][]interface{}
+	if err := json.Unmarshal([]byte(form.Get("scan_vectors")), &vectors); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]map[string][]interface{}{"b": {
+		"12": {float64(5), "1234"},
+		"40": {float64(7), "99"},
+	}}
+	if !reflect.DeepEqual(vectors, expected) {
+		t.Fatalf("Expected scan vectors %v got %v", expected, vectors)
+	}
+
+	// a scan consistency set explicitly wins
+	query(WithQueryOptions(ctx, QueryOptions{ScanConsistency: NotBounded}))
+	if form.Get("scan_consistency") != "not_bounded" || form.Get("scan_vectors") != "" {
+		t.Fatalf("Unexpected consistency %q %q", form.Get("scan_consistency"), form.Get("scan_vectors"))
+	}
+
+	// DML that failed and reported that it wrote nothing changes nothing
+	if _, err := db.ExecContext(ctx, "insert into b values ('x', {})"); err == nil {
+		t.Fatal("Expected error for failed insert")
+	}
+	query(ctx)
+	if form.Get("scan_consistency") != "at_plus" || form.Get("scan_vectors") == "" {
+		t.Fatalf("Unexpected consistency %q %q", form.Get("scan_consistency"), form.Get("scan_vectors"))
+	}
+
+	// the tokens of DML are not known, queries after it are request_plus
+	// until reset
+	if _, err := db.ExecContext(ctx, "insert into b values ('k', {})"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		query(ctx)
+		if form.Get("scan_consistency") != "request_plus" || form.Get("scan_vectors") != "" {
+			t.Fatalf("Unexpected consistency %q %q", form.Get("scan_consistency"), form.Get("scan_vectors"))
+		}
+	}
+	cw.Reset()
+	query(ctx)
+	if form.Get("scan_consistency") != "" || form.Get("scan_vectors") != "" {
+		t.Fatalf("Unexpected consistency %q %q", form.Get("scan_consistency"), form.Get("scan_vectors"))
+	}
+
+	// the same for DML run as a query, whether its rows are all read or
+	// closed before its mutations are reported
+	rows, err := db.QueryContext(ctx, "update b set x = 1 returning meta().id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+	}
+	if err := rows.Close(); err != nil {
+		t.Fatal(err)
+	}
+	query(ctx)
+	if form.Get("scan_consistency") != "request_plus" {
+		t.Fatalf("Expected request_plus got %q", form.Get("scan_consistency"))
+	}
+	cw.Reset()
+
+	var id string
+	if err := db.QueryRowContext(ctx, "update b set x = 1 returning meta().id").Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	query(ctx)
+	if form.Get("scan_consistency") != "request_plus" {
+		t.Fatalf("Expected request_plus got %q", form.Get("scan_consistency"))
+	}
+	cw.Reset()
+	query(ctx)
+	if form.Get("scan_consistency") != "" || form.Get("scan_vectors") != "" {
+		t.Fatalf("Unexpected consistency %q %q", form.Get("scan_consistency"), form.Get("scan_vectors"))
+	}
+
+	// at_plus needs writes to wait for
+	form = nil
+	ctx = WithQueryOptions(context.Background(), QueryOptions{ScanConsistency: AtPlus})
+	if err := db.QueryRowContext(ctx, "select id from b").Scan(new(int)); err == nil || form != nil {
+		t.Fatal("Expected error for at_plus without ConsistentWith")
+	}
+}
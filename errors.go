@@ -0,0 +1,145 @@
+//  Copyright 2014-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package go_n1ql
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// N1QLError is an error reported by the query service. Errors with the
+// same code match each other, so that
+//
+//	errors.Is(err, &go_n1ql.N1QLError{Code: 4040})
+//
+// tells whether a request failed with that code.
+type N1QLError struct {
+	Code       int
+	Message    string
+	Reason     map[string]interface{}
+	Retry      bool
+	RequestID  string
+	HTTPStatus int
+}
+
+func (e *N1QLError) Error() string {
+	return fmt.Sprintf("Code : %d Message : %s", e.Code, e.Message)
+}
+
+func (e *N1QLError) Is(target error) bool {
+	t, ok := target.(*N1QLError)
+	return ok && t.Code == e.Code
+}
+
+// N1QLErrors are the errors reported by the query service for a request.
+// errors.As finds the individual errors.
+type N1QLErrors []*N1QLError
+
+func (e N1QLErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, " ")
+}
+
+func (e N1QLErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, err := range e {
+		errs[i] = err
+	}
+	return errs
+}
+
+// Decode the errors field of a response. Errors that cannot be decoded
+// are reported as they are.
+func decodeErrors(errors *json.RawMessage, requestID string, httpStatus int) N1QLErrors {
+	var errs []struct {
+		Code   int                    `json:"code"`
+		Msg    string                 `json:"msg"`
+		Reason map[string]interface{} `json:"reason"`
+		Retry  bool                   `json:"retry"`
+	}
+
+	if err := json.Unmarshal(*errors, &errs); err != nil || len(errs) == 0 {
+		return N1QLErrors{{Message: string(*errors), RequestID: requestID, HTTPStatus: httpStatus}}
+	}
+
+	n1qlErrs := make(N1QLErrors, len(errs))
+	for i, e := range errs {
+		n1qlErrs[i] = &N1QLError{
+			Code:       e.Code,
+			Message:    e.Msg,
+			Reason:     e.Reason,
+			Retry:      e.Retry,
+			RequestID:  requestID,
+			HTTPStatus: httpStatus,
+		}
+	}
+	return n1qlErrs
+}
+
+// N1QLWarning is a warning reported by the query service along with the
+// results of a request, such as an index hint that could not be followed.
+type N1QLWarning struct {
+	Code      int
+	Message   string
+	RequestID string
+}
+
+func (w N1QLWarning) String() string {
+	return fmt.Sprintf("Code : %d Message : %s", w.Code, w.Message)
+}
+
+// Decode the warnings field of a response
+func decodeWarnings(warnings *json.RawMessage, requestID string) []N1QLWarning {
+	var warns []struct {
+		Code int    `json:"code"`
+		Msg  string `json:"msg"`
+	}
+
+	if err := json.Unmarshal(*warnings, &warns); err != nil {
+		return []N1QLWarning{{Message: string(*warnings), RequestID: requestID}}
+	}
+
+	n1qlWarns := make([]N1QLWarning, len(warns))
+	for i, w := range warns {
+		n1qlWarns[i] = N1QLWarning{Code: w.Code, Message: w.Msg, RequestID: requestID}
+	}
+	return n1qlWarns
+}
+
+// How much of the body of a failed response is read
+var N1QL_MAX_ERROR_BYTES int64 = 64 * 1024
+
+// The error for a response with a status other than 200. The query
+// service reports the errors in the body, as for other responses.
+func responseError(resp *http.Response) error {
+	bod, _ := ioutil.ReadAll(io.LimitReader(resp.Body, N1QL_MAX_ERROR_BYTES))
+
+	var resultMap map[string]*json.RawMessage
+	if err := json.Unmarshal(bod, &resultMap); err == nil && resultMap["errors"] != nil {
+		return decodeErrors(resultMap["errors"], decodeRequestID(resultMap["requestID"]), resp.StatusCode)
+	}
+
+	return &N1QLError{Message: strings.TrimSpace(string(bod)), HTTPStatus: resp.StatusCode}
+}
+
+// the request id of a response, if any
+func decodeRequestID(requestID *json.RawMessage) string {
+	var id string
+	if requestID != nil {
+		_ = json.Unmarshal(*requestID, &id)
+	}
+	return id
+}
@@ -0,0 +1,207 @@
+//  Copyright 2014-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package go_n1ql
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parameters found in a statement
+type statementParams struct {
+	// highest positional parameter, either ? or $n
+	positional int
+
+	// named parameters, without the $
+	named []string
+}
+
+// Check that the arguments match the parameters of the statement
+func (params *statementParams) checkArgs(args []driver.NamedValue) error {
+	if len(args) > 0 && args[0].Name != "" {
+		if params.positional > 0 {
+			return ErrMixedParameters
+		}
+		return nil
+	}
+
+	if len(params.named) > 0 && len(args) > 0 {
+		return ErrMixedParameters
+	}
+	if params.positional != len(args) {
+		return fmt.Errorf("Argument count mismatch %d != %d", params.positional, len(args))
+	}
+	return nil
+}
+
+// Rewrite the ? placeholders of a statement as $1, $2 ... Placeholders
+// inside string literals, quoted identifiers and comments are left alone.
+// If the statement also has $n placeholders, the ? placeholders are
+// numbered after the highest of them.
+func rewritePlaceholders(query string) (string, statementParams) {
+	rewritten, params, count, highest := scanPlaceholders(query, 0)
+
+	// the $n placeholders may follow the ? ones, so this takes a second pass
+	if count > 0 && highest > 0 {
+		rewritten, params, _, _ = scanPlaceholders(query, highest)
+	}
+	return rewritten, params
+}
+
+// Rewrite the ? placeholders numbering them from offset+1, and return the
+// number of ? placeholders and the highest $n placeholder
+func scanPlaceholders(query string, offset int) (string, statementParams, int, int) {
+	var params statementParams
+	var out strings.Builder
+	var count, highest int
+
+	out.Grow(len(query))
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == '\'' || c == '"':
+			end := scanQuoted(query, i, c, true)
+			out.WriteString(query[i:end])
+			i = end
+		case c == '`':
+			end := scanQuoted(query, i, c, false)
+			out.WriteString(query[i:end])
+			i = end
+		case c == '-' && strings.HasPrefix(query[i:], "--"):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				end = len(query)
+			} else {
+				end += i + 1
+			}
+			out.WriteString(query[i:end])
+			i = end
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				end = len(query)
+			} else {
+				end += i + 4
+			}
+			out.WriteString(query[i:end])
+			i = end
+		case c == '?':
+			count++
+			out.WriteString("$")
+			out.WriteString(strconv.Itoa(offset + count))
+			if offset+count > params.positional {
+				params.positional = offset + count
+			}
+			i++
+		case c == '$':
+			end := scanIdentifier(query, i+1)
+			name := query[i+1 : end]
+			if n, err := strconv.Atoi(name); err == nil {
+				if n > params.positional {
+					params.positional = n
+				}
+				if n > highest {
+					highest = n
+				}
+			} else if name != "" && isIdentifierStart(name[0]) && !params.hasNamed(name) {
+				params.named = append(params.named, name)
+			}
+			out.WriteString(query[i:end])
+			i = end
+		case isIdentifierStart(c):
+			// identifiers may contain $, which is not a parameter
+			end := scanIdentifier(query, i)
+			out.WriteString(query[i:end])
+			i = end
+		default:
+			out.WriteByte(c)
+			i++
+		}
+	}
+
+	return out.String(), params, count, highest
+}
+
+func (params *statementParams) hasNamed(name string) bool {
+	for _, n := range params.named {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the end of the quoted token starting at start. Quotes are
+// escaped by doubling them or, if backslash is set, with a backslash.
+func scanQuoted(query string, start int, quote byte, backslash bool) int {
+	for i := start + 1; i < len(query); i++ {
+		switch query[i] {
+		case '\\':
+			if backslash {
+				i++
+			}
+		case quote:
+			if i+1 < len(query) && query[i+1] == quote {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+
+	// unterminated, let the server report it
+	return len(query)
+}
+
+func isIdentifierStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func scanIdentifier(query string, start int) int {
+	i := start
+	for i < len(query) {
+		c := query[i]
+		if !isIdentifierStart(c) && !(c >= '0' && c <= '9') && c != '$' {
+			break
+		}
+		i++
+	}
+	return i
+}
+
+// Returns the first keyword of a statement in upper case, skipping
+// comments and opening parentheses
+func statementKeyword(query string) string {
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '(':
+			i++
+		case strings.HasPrefix(query[i:], "--"):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				return ""
+			}
+			i += end + 1
+		case strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				return ""
+			}
+			i += end + 4
+		case isIdentifierStart(c):
+			return strings.ToUpper(query[i:scanIdentifier(query, i)])
+		default:
+			return ""
+		}
+	}
+	return ""
+}
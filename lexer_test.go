@@ -0,0 +1,77 @@
+//  Copyright 2014-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package go_n1ql
+
+import (
+	"database/sql/driver"
+	"testing"
+)
+
+func TestRewritePlaceholders(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+		count    int
+	}{
+		{"select * from b where a = ? and c = ?", "select * from b where a = $1 and c = $2", 2},
+		{"select 'what?' from b where a = ?", "select 'what?' from b where a = $1", 1},
+		{`select "it\"s?" from b where a = ?`, `select "it\"s?" from b where a = $1`, 1},
+		{"select 'it''s?', ? from b", "select 'it''s?', $1 from b", 1},
+		{"select `odd?name` from b where a = ?", "select `odd?name` from b where a = $1", 1},
+		{"select a -- why?\nfrom b where a = ?", "select a -- why?\nfrom b where a = $1", 1},
+		{"select a /* why? */ from b where a = ?", "select a /* why? */ from b where a = $1", 1},
+		{"select a from b where a = $1 or c = $10", "select a from b where a = $1 or c = $10", 10},
+		{"select a$b from b", "select a$b from b", 0},
+		{"select $1, ? from b", "select $1, $2 from b", 2},
+		{"select ?, $2, ? from b", "select $3, $2, $4 from b", 4},
+		{"select 'unterminated ?", "select 'unterminated ?", 0},
+	}
+
+	for _, test := range tests {
+		query, params := rewritePlaceholders(test.query)
+		if query != test.expected {
+			t.Errorf("Rewriting %q: expected %q got %q", test.query, test.expected, query)
+		}
+		if params.positional != test.count {
+			t.Errorf("Rewriting %q: expected %d parameters got %d", test.query, test.count, params.positional)
+		}
+	}
+}
+
+func TestNamedParameters(t *testing.T) {
+	_, params := rewritePlaceholders("select a from b where city = $city and name = '$name' and age > $age and town = $city")
+	if len(params.named) != 2 || params.named[0] != "city" || params.named[1] != "age" {
+		t.Fatalf("Unexpected named parameters %v", params.named)
+	}
+
+	if err := params.checkArgs([]driver.NamedValue{{Name: "city", Ordinal: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := params.checkArgs([]driver.NamedValue{{Ordinal: 1}}); err != ErrMixedParameters {
+		t.Fatalf("Expected ErrMixedParameters, got %v", err)
+	}
+}
+
+func TestStatementKeyword(t *testing.T) {
+	tests := map[string]string{
+		"select * from b":                      "SELECT",
+		"  \n\tSelect 1":                       "SELECT",
+		"(select 1) union (select 2)":          "SELECT",
+		"-- find them\nDELETE FROM b":          "DELETE",
+		"/* upsert? */ upsert into b values 1": "UPSERT",
+		"":                                     "",
+		"/* unterminated":                      "",
+	}
+
+	for query, expected := range tests {
+		if keyword := statementKeyword(query); keyword != expected {
+			t.Errorf("Keyword of %q: expected %q got %q", query, expected, keyword)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+//  Copyright 2014-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package go_n1ql
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// N1QLMetadata describes the execution of a request by the query service.
+// Signature and Profile are passed on as sent by the server, Profile is
+// only sent if profiling was requested with the profile parameter.
+type N1QLMetadata struct {
+	RequestID       string
+	ClientContextID string
+	Status          string
+	Metrics         N1QLMetrics
+	Signature       json.RawMessage
+	Profile         json.RawMessage
+	Warnings        []N1QLWarning
+}
+
+// N1QLMetrics are the metrics of a request
+type N1QLMetrics struct {
+	ElapsedTime   time.Duration
+	ExecutionTime time.Duration
+	ResultCount   int64
+	ResultSize    int64
+	MutationCount int64
+	SortCount     int64
+	ErrorCount    int64
+	WarningCount  int64
+}
+
+// Decode the metadata from the fields of a response, other than the
+// warnings. The client context id is the one sent unless echoed.
+func decodeMetadata(fields map[string]*json.RawMessage, clientContextID string) (N1QLMetadata, error) {
+	md := N1QLMetadata{ClientContextID: clientContextID}
+
+	md.RequestID = decodeRequestID(fields["requestID"])
+	if id := fields["clientContextID"]; id != nil {
+		_ = json.Unmarshal(*id, &md.ClientContextID)
+	}
+	if status := fields["status"]; status != nil {
+		_ = json.Unmarshal(*status, &md.Status)
+	}
+	if signature := fields["signature"]; signature != nil {
+		md.Signature = append(json.RawMessage(nil), *signature...)
+	}
+	if profile := fields["profile"]; profile != nil {
+		md.Profile = append(json.RawMessage(nil), *profile...)
+	}
+
+	if metrics := fields["metrics"]; metrics != nil {
+		var err error
+		md.Metrics, err = decodeMetrics(metrics)
+		if err != nil {
+			return md, fmt.Errorf("N1QL: Failed to unmarshal response. Error %v", err)
+		}
+	}
+	return md, nil
+}
+
+func decodeMetrics(metrics *json.RawMessage) (N1QLMetrics, error) {
+	var m struct {
+		ElapsedTime   string `json:"elapsedTime"`
+		ExecutionTime string `json:"executionTime"`
+		ResultCount   int64  `json:"resultCount"`
+		ResultSize    int64  `json:"resultSize"`
+		MutationCount int64  `json:"mutationCount"`
+		SortCount     int64  `json:"sortCount"`
+		ErrorCount    int64  `json:"errorCount"`
+		WarningCount  int64  `json:"warningCount"`
+	}
+
+	if err := json.Unmarshal(*metrics, &m); err != nil {
+		return N1QLMetrics{}, err
+	}
+
+	// durations are formatted as by Go, such as 1.5ms
+	elapsed, _ := time.ParseDuration(m.ElapsedTime)
+	execution, _ := time.ParseDuration(m.ExecutionTime)
+
+	return N1QLMetrics{
+		ElapsedTime:   elapsed,
+		ExecutionTime: execution,
+		ResultCount:   m.ResultCount,
+		ResultSize:    m.ResultSize,
+		MutationCount: m.MutationCount,
+		SortCount:     m.SortCount,
+		ErrorCount:    m.ErrorCount,
+		WarningCount:  m.WarningCount,
+	}, nil
+}
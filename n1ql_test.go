@@ -9,9 +9,21 @@
 package go_n1ql
 
 import (
+	"context"
+	"database/sql"
 	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 // This test assumes a Couchbase instance is accessible on the local machine,
@@ -88,3 +100,947 @@ func TestConnection(t *testing.T) {
 	}
 
 }
+
+// fakeQueryService mimics the query service REST endpoint. The handler
+// is called for every statement and returns the response body. Requests
+// in flight are listed by the active requests endpoint and can be
+// cancelled through it.
+func fakeQueryService(t *testing.T, handler func(r *http.Request) string) *httptest.Server {
+	var lock sync.Mutex
+	active := make(map[string]context.CancelFunc)
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == N1QL_ACTIVE_REQUESTS_ENDPOINT && r.Method == "GET":
+			lock.Lock()
+			list := make([]map[string]string, 0, len(active))
+			for id := range active {
+				list = append(list, map[string]string{"requestId": "r-" + id, "clientContextID": id})
+			}
+			lock.Unlock()
+			json.NewEncoder(w).Encode(list)
+			return
+		case strings.HasPrefix(r.URL.Path, N1QL_ACTIVE_REQUESTS_ENDPOINT+"/r-") && r.Method == "DELETE":
+			lock.Lock()
+			cancel, ok := active[strings.TrimPrefix(r.URL.Path, N1QL_ACTIVE_REQUESTS_ENDPOINT+"/r-")]
+			lock.Unlock()
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			cancel()
+			return
+		case r.URL.Path != N1QL_SERVICE_ENDPOINT:
+			http.NotFound(w, r)
+			return
+		}
+
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("Failed to parse request %v", err)
+		}
+		if r.Form.Get("statement") == N1QL_DEFAULT_STATEMENT {
+			fmt.Fprint(w, `{"signature": {"$1": "number"}, "results": [{"$1": 1}], "status": "success"}`)
+			return
+		}
+
+		id := r.Form.Get("client_context_id")
+		// like the query service, keep running when the client goes away
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		lock.Lock()
+		active[id] = cancel
+		lock.Unlock()
+		defer func() {
+			lock.Lock()
+			delete(active, id)
+			lock.Unlock()
+			cancel()
+		}()
+
+		fmt.Fprint(w, handler(r.WithContext(ctx)))
+	}))
+}
+
+func TestConnector(t *testing.T) {
+	var user string
+	var timeout string
+	srv := fakeQueryService(t, func(r *http.Request) string {
+		user, _, _ = r.BasicAuth()
+		timeout = r.Form.Get("timeout")
+		return `{"signature": {"name": "json"}, "results": [{"name": "irish"}], "status": "success"}`
+	})
+	defer srv.Close()
+
+	connector, err := NewConnector(Config{
+		Endpoint:    srv.URL,
+		Username:    "Administrator",
+		Password:    "password",
+		QueryParams: map[string]string{"timeout": "10s"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	var name string
+	if err := db.QueryRow("select name from contacts").Scan(&name); err != nil {
+		t.Fatal(err)
+	}
+
+	if user != "Administrator" {
+		t.Fatalf("Expected credentials for Administrator, got %q", user)
+	}
+	if timeout != "10s" {
+		t.Fatalf("Expected timeout 10s, got %q", timeout)
+	}
+
+	if _, err := NewConnector(Config{}); err == nil {
+		t.Fatal("Expected error for missing endpoint")
+	}
+}
+
+func TestContextDeadline(t *testing.T) {
+	var timeout string
+	srv := fakeQueryService(t, func(r *http.Request) string {
+		timeout = r.Form.Get("timeout")
+		if r.Form.Get("statement") == "select sleep" {
+			<-r.Context().Done()
+		}
+		return `{"signature": {"name": "json"}, "results": [], "metrics": {"mutationCount": 0}, "status": "success"}`
+	})
+	defer srv.Close()
+
+	connector, err := NewConnector(Config{Endpoint: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if _, err := db.ExecContext(ctx, "delete from contacts"); err != nil {
+		t.Fatal(err)
+	}
+	d, err := time.ParseDuration(timeout)
+	if err != nil || d <= 0 || d > time.Minute {
+		t.Fatalf("Expected timeout from context deadline, got %q", timeout)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err = db.QueryContext(ctx, "select sleep")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestServerSideCancel(t *testing.T) {
+	stopped := make(chan string, 1)
+	srv := fakeQueryService(t, func(r *http.Request) string {
+		<-r.Context().Done()
+		stopped <- r.Form.Get("client_context_id")
+		return ""
+	})
+	defer srv.Close()
+
+	connector, err := NewConnector(Config{Endpoint: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	_, err = db.QueryContext(ctx, "select sleep")
+
+	var cerr *RequestCancelledError
+	if !errors.As(err, &cerr) {
+		t.Fatalf("Expected RequestCancelledError, got %v", err)
+	}
+	if !errors.Is(err, context.Canceled) || cerr.CancelErr != nil {
+		t.Fatalf("Expected request to be cancelled, got %v", err)
+	}
+	if id := <-stopped; id != cerr.ClientContextID {
+		t.Fatalf("Expected request %s to be stopped, got %s", cerr.ClientContextID, id)
+	}
+}
+
+func TestPositionalArgs(t *testing.T) {
+	var statement, args string
+	srv := fakeQueryService(t, func(r *http.Request) string {
+		statement = r.Form.Get("statement")
+		args = r.Form.Get("args")
+		return `{"signature": {"name": "json"}, "results": [], "status": "success"}`
+	})
+	defer srv.Close()
+
+	connector, err := NewConnector(Config{Endpoint: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	rows, err := db.Query("select name from contacts where name = ? and age > ?", `irish" or "1"="1`, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows.Close()
+
+	if statement != "select name from contacts where name = $1 and age > $2" {
+		t.Fatalf("Unexpected statement %s", statement)
+	}
+	if args != `["irish\" or \"1\"=\"1",10]` {
+		t.Fatalf("Unexpected args %s", args)
+	}
+
+	if _, err := db.Exec("upsert into contacts values (?, ?)", "irish", []byte("{not json")); err == nil {
+		t.Fatal("Expected error for invalid JSON argument")
+	}
+}
+
+func TestNamedArgs(t *testing.T) {
+	var city string
+	srv := fakeQueryService(t, func(r *http.Request) string {
+		if strings.HasPrefix(r.Form.Get("statement"), "PREPARE") {
+			return `{"signature": {"name": "json"}, "results": [{"name": "p1", "operator": {}}], "status": "success"}`
+		}
+		city = r.Form.Get("$city")
+		return `{"signature": {"name": "json"}, "results": [], "status": "success"}`
+	})
+	defer srv.Close()
+
+	connector, err := NewConnector(Config{Endpoint: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	rows, err := db.Query("select name from contacts where city = $city", sql.Named("city", "London"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows.Close()
+
+	if city != `"London"` {
+		t.Fatalf("Unexpected named parameter %s", city)
+	}
+
+	_, err = db.Query("select name from contacts where city = $city and age > ?", sql.Named("city", "London"), 10)
+	if !errors.Is(err, ErrMixedParameters) {
+		t.Fatalf("Expected ErrMixedParameters, got %v", err)
+	}
+
+	stmt, err := db.Prepare("select name from contacts where city = $city")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+
+	city = ""
+	rows, err = stmt.Query(sql.Named("city", "Dublin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows.Close()
+
+	if city != `"Dublin"` {
+		t.Fatalf("Unexpected named parameter %s", city)
+	}
+
+	// prepared statements check their arguments as well
+	positional, err := db.Prepare("select name from contacts where age > ?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer positional.Close()
+
+	city = ""
+	if err := positional.QueryRow(sql.Named("city", "Dublin")).Scan(new(string)); !errors.Is(err, ErrMixedParameters) {
+		t.Fatalf("Expected ErrMixedParameters, got %v", err)
+	}
+	if city != "" {
+		t.Fatal("Request sent with mixed parameters")
+	}
+
+	if _, err := db.Prepare("select name from contacts where city = $city and age > ?"); !errors.Is(err, ErrMixedParameters) {
+		t.Fatalf("Expected ErrMixedParameters, got %v", err)
+	}
+}
+
+func TestArgEncoding(t *testing.T) {
+	var args string
+	srv := fakeQueryService(t, func(r *http.Request) string {
+		args = r.Form.Get("args")
+		return `{"signature": null, "results": [], "metrics": {"mutationCount": 1}, "status": "success"}`
+	})
+	defer srv.Close()
+
+	connector, err := NewConnector(Config{Endpoint: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	type contact struct {
+		Name     string   `json:"name"`
+		Children []string `json:"children,omitempty"`
+	}
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	_, err = db.Exec("upsert into contacts values (?, ?, ?, ?, ?, ?, ?)",
+		contact{Name: "dave", Children: []string{"aiden"}},
+		map[string]int{"age": 60},
+		[]interface{}{1, "two"},
+		ts,
+		1e21,
+		sql.NullString{},
+		[]byte(`{"raw": true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `[{"name":"dave","children":["aiden"]},{"age":60},[1,"two"],"2020-01-02T03:04:05Z",1e+21,null,{"raw":true}]`
+	if args != expected {
+		t.Fatalf("Expected args %s got %s", expected, args)
+	}
+
+	if _, err = db.Exec("upsert into contacts values (?, ?)", "nan", math.NaN()); err == nil {
+		t.Fatal("Expected error for NaN argument")
+	}
+}
+
+func TestColumnOrder(t *testing.T) {
+	srv := fakeQueryService(t, func(r *http.Request) string {
+		return `{"signature": {"type": "json", "name": "json", "age": "number"},
+			"results": [{"name": "dave", "type": "contact", "age": 60}], "status": "success"}`
+	})
+	defer srv.Close()
+
+	connector, err := NewConnector(Config{Endpoint: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	rows, err := db.Query("select type, name, age from contacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(columns, ",") != "type,name,age" {
+		t.Fatalf("Unexpected columns %v", columns)
+	}
+
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if columnTypes[2].DatabaseTypeName() != "NUMBER" || columnTypes[2].ScanType().Kind() != reflect.Float64 {
+		t.Fatalf("Unexpected column type %s %v", columnTypes[2].DatabaseTypeName(), columnTypes[2].ScanType())
+	}
+	if nullable, ok := columnTypes[0].Nullable(); !nullable || !ok {
+		t.Fatal("Expected nullable column")
+	}
+
+	if !rows.Next() {
+		t.Fatal("Expected a row")
+	}
+	var typ, name string
+	var age int64
+	if err := rows.Scan(&typ, &name, &age); err != nil {
+		t.Fatal(err)
+	}
+	if typ != "contact" || name != "dave" || age != 60 {
+		t.Fatalf("Unexpected row %s %s %d", typ, name, age)
+	}
+}
+
+func TestColumnValues(t *testing.T) {
+	srv := fakeQueryService(t, func(r *http.Request) string {
+		switch r.Form.Get("statement") {
+		case "select raw name from contacts":
+			return `{"signature": "json", "results": ["dave"], "status": "success"}`
+		case "select * from contacts":
+			return `{"signature": {"*": "*"}, "results": [{"contacts": {"name": "dave"}}], "status": "success"}`
+		}
+		return `{"signature": {"name": "json", "age": "number", "score": "number", "married": "boolean", "children": "json", "spouse": "json"},
+			"results": [{"name": "dave", "age": 60, "score": 1.5, "married": true, "children": [{"name": "aiden"}], "spouse": null}],
+			"status": "success"}`
+	})
+	defer srv.Close()
+
+	for _, rawJSON := range []bool{false, true} {
+		connector, err := NewConnector(Config{Endpoint: srv.URL, RawJSONMode: rawJSON})
+		if err != nil {
+			t.Fatal(err)
+		}
+		db := sql.OpenDB(connector)
+		defer db.Close()
+
+		var values [6]interface{}
+		row := db.QueryRow("select name, age, score, married, children, spouse from contacts")
+		if err := row.Scan(&values[0], &values[1], &values[2], &values[3], &values[4], &values[5]); err != nil {
+			t.Fatal(err)
+		}
+
+		var name, document string
+		if err := db.QueryRow("select raw name from contacts").Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.QueryRow("select * from contacts").Scan(&document); err != nil {
+			t.Fatal(err)
+		}
+
+		if rawJSON {
+			got := fmt.Sprintf("%s %s %s %s %s %s", values[0], values[1], values[2], values[3], values[4], values[5])
+			if got != `"dave" 60 1.5 true [{"name":"aiden"}] null` {
+				t.Fatalf("Unexpected raw values %s", got)
+			}
+			if name != `"dave"` {
+				t.Fatalf("Unexpected raw value %s", name)
+			}
+		} else {
+			got := fmt.Sprintf("%v %v %v %v %s %v", values[0], values[1], values[2], values[3], values[4], values[5])
+			if got != `dave 60 1.5 true [{"name":"aiden"}] <nil>` {
+				t.Fatalf("Unexpected values %s", got)
+			}
+			if _, ok := values[1].(int64); !ok {
+				t.Fatalf("Expected int64 got %T", values[1])
+			}
+			if name != "dave" {
+				t.Fatalf("Unexpected value %s", name)
+			}
+		}
+		if document != `{"contacts":{"name":"dave"}}` {
+			t.Fatalf("Unexpected document %s", document)
+		}
+	}
+}
+
+func TestMissingValues(t *testing.T) {
+	srv := fakeQueryService(t, func(r *http.Request) string {
+		return `{"signature": {"name": "json", "spouse": "json", "nickname": "json"},
+			"results": [{"name": "dave", "spouse": null}], "status": "success"}`
+	})
+	defer srv.Close()
+
+	for _, reportMissing := range []bool{false, true} {
+		connector, err := NewConnector(Config{Endpoint: srv.URL, ReportMissing: reportMissing})
+		if err != nil {
+			t.Fatal(err)
+		}
+		db := sql.OpenDB(connector)
+		defer db.Close()
+
+		var name string
+		var spouse, nickname JSONValue
+		row := db.QueryRow("select name, spouse, nickname from contacts")
+		if err := row.Scan(&name, &spouse, &nickname); err != nil {
+			t.Fatal(err)
+		}
+		if !spouse.Null || spouse.Missing {
+			t.Fatalf("Expected spouse to be NULL, got %+v", spouse)
+		}
+		if nickname.Missing != reportMissing || nickname.Null == reportMissing {
+			t.Fatalf("Unexpected nickname %+v", nickname)
+		}
+
+		if !reportMissing {
+			var ns sql.NullString
+			if err := db.QueryRow("select name, spouse, nickname from contacts").Scan(&name, &ns, &ns); err != nil {
+				t.Fatal(err)
+			}
+			if ns.Valid {
+				t.Fatal("Expected MISSING value to be NULL")
+			}
+		}
+	}
+}
+
+func TestStreamingRows(t *testing.T) {
+	firstRowRead := make(chan bool)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("statement") == N1QL_DEFAULT_STATEMENT {
+			fmt.Fprint(w, `{"results": [{"$1": 1}], "status": "success"}`)
+			return
+		}
+
+		// the signature follows the results
+		fmt.Fprint(w, `{"requestID": "1", "results": [{"name": "dave", "age": 60}`)
+		w.(http.Flusher).Flush()
+		select {
+		case <-firstRowRead:
+		case <-time.After(5 * time.Second):
+		}
+		fmt.Fprint(w, `, {"name": "irish", "age": 8}], "signature": {"name": "json", "age": "number"}, "status": "success"}`)
+	}))
+	defer srv.Close()
+
+	connector, err := NewConnector(Config{Endpoint: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	rows, err := db.Query("select name, age from contacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		var age int
+		if err := rows.Scan(&name, &age); err != nil {
+			t.Fatal(err)
+		}
+		if len(names) == 0 {
+			close(firstRowRead)
+		}
+		names = append(names, name)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(names, ",") != "dave,irish" {
+		t.Fatalf("Unexpected rows %v", names)
+	}
+}
+
+func TestRowsClose(t *testing.T) {
+	var lock sync.Mutex
+	var stalled, cancelled []string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == N1QL_ACTIVE_REQUESTS_ENDPOINT:
+			lock.Lock()
+			defer lock.Unlock()
+			list := make([]map[string]string, 0, len(stalled))
+			for _, id := range stalled {
+				list = append(list, map[string]string{"requestId": "r-" + id, "clientContextID": id})
+			}
+			json.NewEncoder(w).Encode(list)
+			return
+		case strings.HasPrefix(r.URL.Path, N1QL_ACTIVE_REQUESTS_ENDPOINT+"/r-"):
+			lock.Lock()
+			defer lock.Unlock()
+			cancelled = append(cancelled, strings.TrimPrefix(r.URL.Path, N1QL_ACTIVE_REQUESTS_ENDPOINT+"/r-"))
+			return
+		}
+
+		r.ParseForm()
+		if r.Form.Get("statement") == N1QL_DEFAULT_STATEMENT {
+			fmt.Fprint(w, `{"results": [{"$1": 1}], "status": "success"}`)
+			return
+		}
+
+		lock.Lock()
+		stalled = append(stalled, r.Form.Get("client_context_id"))
+		lock.Unlock()
+
+		// send one row, then stall
+		fmt.Fprint(w, `{"signature": {"name": "json"}, "results": [{"name": "dave"}`)
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer srv.Close()
+
+	connector, err := NewConnector(Config{Endpoint: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	start := time.Now()
+
+	// closing early
+	rows, err := db.Query("select name from contacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rows.Next() {
+		t.Fatal("Expected a row")
+	}
+	if err := rows.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// closing while Next is waiting on the server
+	conn, err := OpenN1QLConnection(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drows, err := conn.(*n1qlConn).QueryContext(context.Background(), "select name from contacts", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dest := make([]driver.Value, 1)
+	if err := drows.Next(dest); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		drows.Next(dest)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	drows.Close()
+	wg.Wait()
+
+	if err := drows.Next(dest); err != io.EOF {
+		t.Fatalf("Expected EOF after Close, got %v", err)
+	}
+
+	// closing the rows is not cancelling the request
+	lock.Lock()
+	if len(cancelled) != 0 {
+		t.Fatalf("Unexpected cancellations %v", cancelled)
+	}
+	lock.Unlock()
+
+	// the caller giving up between rows cancels the request on the server
+	ctx, cancel := context.WithCancel(context.Background())
+	rows, err = db.QueryContext(ctx, "select name from contacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rows.Next() {
+		t.Fatal("Expected a row")
+	}
+	cancel()
+
+	// database/sql closes the rows in the background
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		lock.Lock()
+		n := len(cancelled)
+		lock.Unlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Request not cancelled on the server")
+		}
+	}
+	if rows.Next() {
+		t.Fatal("Expected no more rows")
+	}
+	lock.Lock()
+	if cancelled[0] != stalled[len(stalled)-1] {
+		t.Fatalf("Expected request %s to be cancelled got %s", stalled[len(stalled)-1], cancelled[0])
+	}
+	lock.Unlock()
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Closing rows took %v", elapsed)
+	}
+}
+
+func TestConcurrentRows(t *testing.T) {
+	srv := fakeQueryService(t, func(r *http.Request) string {
+		return `{"signature": {"id": "number"}, "results": [{"id": 1}, {"id": 2}, {"id": 3}], "status": "success"}`
+	})
+	defer srv.Close()
+
+	connector, err := NewConnector(Config{Endpoint: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				rows, err := db.Query("select id from b")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				// stop early on every other query
+				for n := 0; rows.Next() && (i%2 == 0 || n < 1); n++ {
+				}
+				if err := rows.Close(); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestN1QLErrors(t *testing.T) {
+	srv := fakeQueryService(t, func(r *http.Request) string {
+		return `{"requestID": "req-1", "errors": [{"code": 3000, "msg": "syntax error - at from"},
+			{"code": 1080, "msg": "Timeout 1ms exceeded", "retry": true, "reason": {"cause": "timeout"}}], "status": "fatal"}`
+	})
+	defer srv.Close()
+
+	connector, err := NewConnector(Config{Endpoint: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	_, qerr := db.Query("select from contacts")
+	_, eerr := db.Exec("delete from contacts where")
+	_, perr := db.Prepare("select from contacts")
+
+	for _, err := range []error{qerr, eerr, perr} {
+		var n1qlErr *N1QLError
+		if !errors.As(err, &n1qlErr) {
+			t.Fatalf("Expected N1QLError, got %v", err)
+		}
+		if n1qlErr.Code != 3000 || n1qlErr.RequestID != "req-1" || n1qlErr.HTTPStatus != 200 {
+			t.Fatalf("Unexpected error %+v", n1qlErr)
+		}
+		if !errors.Is(err, &N1QLError{Code: 1080}) || errors.Is(err, &N1QLError{Code: 4040}) {
+			t.Fatalf("Unexpected error codes %v", err)
+		}
+
+		var n1qlErrs N1QLErrors
+		if !errors.As(err, &n1qlErrs) || len(n1qlErrs) != 2 || !n1qlErrs[1].Retry || n1qlErrs[1].Reason["cause"] != "timeout" {
+			t.Fatalf("Unexpected errors %v", err)
+		}
+	}
+}
+
+func TestErrorsAfterResults(t *testing.T) {
+	srv := fakeQueryService(t, func(r *http.Request) string {
+		return `{"requestID": "req-2", "signature": {"id": "number"}, "results": [{"id": 1}, {"id": 2}],
+			"errors": [{"code": 5000, "msg": "Out of memory"}], "status": "errors"}`
+	})
+	defer srv.Close()
+
+	connector, err := NewConnector(Config{Endpoint: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	rows, err := db.Query("select id from b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	count := 0
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		count++
+	}
+	if count != 2 {
+		t.Fatalf("Expected 2 rows got %d", count)
+	}
+
+	var n1qlErr *N1QLError
+	if !errors.As(rows.Err(), &n1qlErr) || n1qlErr.Code != 5000 || n1qlErr.RequestID != "req-2" {
+		t.Fatalf("Expected error 5000 from rows.Err, got %v", rows.Err())
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch r.Form.Get("statement") {
+		case N1QL_DEFAULT_STATEMENT:
+			fmt.Fprint(w, `{"results": [{"$1": 1}], "status": "success"}`)
+		case "select json":
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"requestID": "req-3", "errors": [{"code": 12003, "msg": "Keyspace not found"}], "status": "fatal"}`)
+		default:
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	connector, err := NewConnector(Config{Endpoint: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	var n1qlErr *N1QLError
+	_, err = db.Query("select json")
+	if !errors.As(err, &n1qlErr) || n1qlErr.Code != 12003 || n1qlErr.HTTPStatus != http.StatusNotFound {
+		t.Fatalf("Expected error 12003, got %v", err)
+	}
+
+	_, err = db.Exec("select text")
+	if !errors.As(err, &n1qlErr) || n1qlErr.HTTPStatus != http.StatusServiceUnavailable || n1qlErr.Message != "Service Unavailable" {
+		t.Fatalf("Expected status 503, got %v", err)
+	}
+}
+
+func TestWarnings(t *testing.T) {
+	srv := fakeQueryService(t, func(r *http.Request) string {
+		return `{"requestID": "req-4", "signature": {"id": "number"}, "results": [{"id": 1}],
+			"warnings": [{"code": 4100, "msg": "Index hint ignored"}], "status": "success",
+			"metrics": {"mutationCount": 1}}`
+	})
+	defer srv.Close()
+
+	var lock sync.Mutex
+	reported := map[string][]N1QLWarning{}
+	connector, err := NewConnector(Config{Endpoint: srv.URL,
+		WarningHandler: func(statement string, warnings []N1QLWarning) {
+			lock.Lock()
+			defer lock.Unlock()
+			reported[statement] = warnings
+		}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	expected := []N1QLWarning{{Code: 4100, Message: "Index hint ignored", RequestID: "req-4"}}
+
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	err = conn.Raw(func(driverConn interface{}) error {
+		rows, err := driverConn.(driver.QueryerContext).QueryContext(context.Background(), "select id from b use index (i)", nil)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		dest := make([]driver.Value, 1)
+		for {
+			if err := rows.Next(dest); err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+		}
+		if warnings := rows.(N1QLRows).Warnings(); !reflect.DeepEqual(warnings, expected) {
+			return fmt.Errorf("Unexpected rows warnings %v", warnings)
+		}
+
+		res, err := driverConn.(driver.ExecerContext).ExecContext(context.Background(), "delete from b use index (i)", nil)
+		if err != nil {
+			return err
+		}
+		if warnings := res.(N1QLResult).Warnings(); !reflect.DeepEqual(warnings, expected) {
+			return fmt.Errorf("Unexpected result warnings %v", warnings)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	for _, statement := range []string{"select id from b use index (i)", "delete from b use index (i)"} {
+		if !reflect.DeepEqual(reported[statement], expected) {
+			t.Fatalf("Unexpected warnings reported for %s: %v", statement, reported[statement])
+		}
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	srv := fakeQueryService(t, func(r *http.Request) string {
+		return `{"requestID": "req-5", "clientContextID": "` + r.Form.Get("client_context_id") + `",
+			"signature": {"id": "number"}, "results": [{"id": 1}, {"id": 2}], "status": "success",
+			"metrics": {"elapsedTime": "1.5ms", "executionTime": "1.25ms", "resultCount": 2, "resultSize": 20, "mutationCount": 2},
+			"profile": {"phaseTimes": {"run": "1ms"}}}`
+	})
+	defer srv.Close()
+
+	connector, err := NewConnector(Config{Endpoint: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	expected := N1QLMetrics{
+		ElapsedTime:   1500 * time.Microsecond,
+		ExecutionTime: 1250 * time.Microsecond,
+		ResultCount:   2,
+		ResultSize:    20,
+		MutationCount: 2,
+	}
+
+	err = conn.Raw(func(driverConn interface{}) error {
+		rows, err := driverConn.(driver.QueryerContext).QueryContext(context.Background(), "select id from b", nil)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		md := rows.(N1QLRows).Metadata()
+		if md.RequestID != "req-5" || md.Status != "" || md.ClientContextID == "" {
+			return fmt.Errorf("Unexpected metadata before the results %+v", md)
+		}
+
+		dest := make([]driver.Value, 1)
+		for rows.Next(dest) == nil {
+		}
+
+		md = rows.(N1QLRows).Metadata()
+		if md.Status != "success" || md.Metrics != expected || string(md.Signature) != `{"id": "number"}` ||
+			string(md.Profile) != `{"phaseTimes": {"run": "1ms"}}` {
+			return fmt.Errorf("Unexpected rows metadata %+v", md)
+		}
+
+		res, err := driverConn.(driver.ExecerContext).ExecContext(context.Background(), "delete from b", nil)
+		if err != nil {
+			return err
+		}
+		md = res.(N1QLResult).Metadata()
+		if md.RequestID != "req-5" || md.Status != "success" || md.Metrics != expected {
+			return fmt.Errorf("Unexpected result metadata %+v", md)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
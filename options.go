@@ -0,0 +1,370 @@
+//  Copyright 2014-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package go_n1ql
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ScanConsistency is the consistency of the index scans of a query
+type ScanConsistency string
+
+const (
+	// Indexes are scanned as they are, the default
+	NotBounded ScanConsistency = "not_bounded"
+
+	// Indexes are scanned once they include all the mutations made
+	// before the request
+	RequestPlus ScanConsistency = "request_plus"
+
+	// Indexes are scanned once they include the writes collected by the
+	// ConsistentWith of the options
+	AtPlus ScanConsistency = "at_plus"
+)
+
+// ProfileMode says how much profiling information is returned with the
+// metadata of a request
+type ProfileMode string
+
+const (
+	ProfileOff     ProfileMode = "off"
+	ProfilePhases  ProfileMode = "phases"
+	ProfileTimings ProfileMode = "timings"
+)
+
+// QueryOptions are the options of the requests sent to the query service.
+// Zero values and nil pointers leave an option unset, so that the query
+// service default applies.
+//
+// Options can be set for all the requests of a connector with
+// Config.QueryOptions, or for the requests made with a context with
+// WithQueryOptions. Options set through the context take precedence, and
+// both take precedence over the string query parameters.
+type QueryOptions struct {
+	// Time the request may run for. A shorter context deadline wins.
+	Timeout time.Duration
+
+	ScanConsistency ScanConsistency
+
+	// Writes the request has to see. Unless another scan consistency is
+	// set, the request is run with at_plus consistency if there are any.
+	// The writes of statements run with it are recorded, see
+	// ConsistentWith.
+	ConsistentWith *ConsistentWith
+
+	// Maximum time to wait for indexes to catch up, and maximum size of
+	// the buffers of index scans
+	ScanWait time.Duration
+	ScanCap  int
+
+	// Whether the request must not change any data
+	Readonly *bool
+
+	// Maximum number of index partitions scanned in parallel
+	MaxParallelism int
+
+	// Number of items execution operators batch, and the maximum number
+	// of batches they buffer
+	PipelineBatch int
+	PipelineCap   int
+
+	// Memory a request may use, in megabytes
+	MemoryQuota int
+
+	// Whether the cost based optimizer is used, and whether documents may
+	// be read from replicas
+	UseCBO     *bool
+	UseReplica *bool
+
+	Profile ProfileMode
+
+	// Bucket and scope in which keyspace names are resolved, such as
+	// "default:travel-sample.inventory"
+	QueryContext string
+
+	// Identifies the request, see RequestCancelledError. A random id is
+	// used if not set. Cancelling a request cancels all those with its id,
+	// so it can only be set with WithQueryOptions.
+	ClientContextID string
+
+	// Further request parameters, sent JSON encoded unless they are strings.
+	// The statement, its arguments and its client context id cannot be set
+	// this way.
+	Raw map[string]interface{}
+}
+
+// request parameters set by the driver, which Raw cannot override
+var reservedParams = map[string]bool{
+	"statement":         true,
+	"args":              true,
+	"prepared":          true,
+	"client_context_id": true,
+}
+
+// Check that the options can be sent
+func (opts *QueryOptions) validate() error {
+	switch {
+	case opts.Timeout < 0:
+		return fmt.Errorf("N1QL: Invalid timeout %v", opts.Timeout)
+	case opts.ScanWait < 0:
+		return fmt.Errorf("N1QL: Invalid scan wait %v", opts.ScanWait)
+	case opts.ScanCap < 0:
+		return fmt.Errorf("N1QL: Invalid scan cap %d", opts.ScanCap)
+	case opts.MaxParallelism < 0:
+		return fmt.Errorf("N1QL: Invalid max parallelism %d", opts.MaxParallelism)
+	case opts.PipelineBatch < 0:
+		return fmt.Errorf("N1QL: Invalid pipeline batch %d", opts.PipelineBatch)
+	case opts.PipelineCap < 0:
+		return fmt.Errorf("N1QL: Invalid pipeline cap %d", opts.PipelineCap)
+	case opts.MemoryQuota < 0:
+		return fmt.Errorf("N1QL: Invalid memory quota %d", opts.MemoryQuota)
+	}
+
+	switch opts.ScanConsistency {
+	case "", NotBounded, RequestPlus, AtPlus:
+	default:
+		return fmt.Errorf("N1QL: Invalid scan consistency %s", opts.ScanConsistency)
+	}
+
+	switch opts.Profile {
+	case "", ProfileOff, ProfilePhases, ProfileTimings:
+	default:
+		return fmt.Errorf("N1QL: Invalid profile %s", opts.Profile)
+	}
+
+	for key, value := range opts.Raw {
+		if key == "" {
+			return fmt.Errorf("N1QL: Key not specified")
+		}
+		if reservedParams[key] || strings.HasPrefix(key, "$") {
+			return fmt.Errorf("N1QL: Parameter %s cannot be set as a raw option", key)
+		}
+		if _, err := json.Marshal(value); err != nil {
+			return fmt.Errorf("N1QL: Invalid value for %s. Error %v", key, err)
+		}
+	}
+	return nil
+}
+
+// Check that the options can be used by all the requests of a connector
+func (opts *QueryOptions) validateShared() error {
+	if opts.ClientContextID != "" {
+		return fmt.Errorf("N1QL: Client context id can only be set per request")
+	}
+	return opts.validate()
+}
+
+// The options set in over, or else in opts
+func (opts QueryOptions) merge(over QueryOptions) QueryOptions {
+	if over.Timeout != 0 {
+		opts.Timeout = over.Timeout
+	}
+	if over.ScanConsistency != "" {
+		opts.ScanConsistency = over.ScanConsistency
+	}
+	if over.ConsistentWith != nil {
+		opts.ConsistentWith = over.ConsistentWith
+	}
+	if over.ScanWait != 0 {
+		opts.ScanWait = over.ScanWait
+	}
+	if over.ScanCap != 0 {
+		opts.ScanCap = over.ScanCap
+	}
+	if over.Readonly != nil {
+		opts.Readonly = over.Readonly
+	}
+	if over.MaxParallelism != 0 {
+		opts.MaxParallelism = over.MaxParallelism
+	}
+	if over.PipelineBatch != 0 {
+		opts.PipelineBatch = over.PipelineBatch
+	}
+	if over.PipelineCap != 0 {
+		opts.PipelineCap = over.PipelineCap
+	}
+	if over.MemoryQuota != 0 {
+		opts.MemoryQuota = over.MemoryQuota
+	}
+	if over.UseCBO != nil {
+		opts.UseCBO = over.UseCBO
+	}
+	if over.UseReplica != nil {
+		opts.UseReplica = over.UseReplica
+	}
+	if over.Profile != "" {
+		opts.Profile = over.Profile
+	}
+	if over.QueryContext != "" {
+		opts.QueryContext = over.QueryContext
+	}
+	if over.ClientContextID != "" {
+		opts.ClientContextID = over.ClientContextID
+	}
+	if len(over.Raw) > 0 {
+		raw := make(map[string]interface{}, len(opts.Raw)+len(over.Raw))
+		for key, value := range opts.Raw {
+			raw[key] = value
+		}
+		for key, value := range over.Raw {
+			raw[key] = value
+		}
+		opts.Raw = raw
+	}
+	return opts
+}
+
+// Set the request parameters of the options
+func (opts *QueryOptions) setValues(v *url.Values) error {
+	for key, value := range opts.Raw {
+		if s, ok := value.(string); ok {
+			v.Set(key, s)
+			continue
+		}
+		bytes, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("N1QL: Invalid value for %s. Error %v", key, err)
+		}
+		v.Set(key, string(bytes))
+	}
+
+	if opts.Timeout > 0 {
+		v.Set("timeout", opts.Timeout.String())
+	}
+	if opts.ConsistentWith != nil && (opts.ScanConsistency == "" || opts.ScanConsistency == AtPlus) {
+		if err := opts.ConsistentWith.setValues(v); err != nil {
+			return err
+		}
+	} else if opts.ScanConsistency == AtPlus {
+		return fmt.Errorf("N1QL: Scan consistency at_plus needs ConsistentWith")
+	} else if opts.ScanConsistency != "" {
+		v.Set("scan_consistency", string(opts.ScanConsistency))
+	}
+	if opts.ScanWait > 0 {
+		v.Set("scan_wait", opts.ScanWait.String())
+	}
+	if opts.ScanCap > 0 {
+		v.Set("scan_cap", strconv.Itoa(opts.ScanCap))
+	}
+	if opts.Readonly != nil {
+		v.Set("readonly", strconv.FormatBool(*opts.Readonly))
+	}
+	if opts.MaxParallelism > 0 {
+		v.Set("max_parallelism", strconv.Itoa(opts.MaxParallelism))
+	}
+	if opts.PipelineBatch > 0 {
+		v.Set("pipeline_batch", strconv.Itoa(opts.PipelineBatch))
+	}
+	if opts.PipelineCap > 0 {
+		v.Set("pipeline_cap", strconv.Itoa(opts.PipelineCap))
+	}
+	if opts.MemoryQuota > 0 {
+		v.Set("memory_quota", strconv.Itoa(opts.MemoryQuota))
+	}
+	if opts.UseCBO != nil {
+		v.Set("use_cbo", strconv.FormatBool(*opts.UseCBO))
+	}
+	if opts.UseReplica != nil {
+		if *opts.UseReplica {
+			v.Set("use_replica", "on")
+		} else {
+			v.Set("use_replica", "off")
+		}
+	}
+	if opts.Profile != "" {
+		v.Set("profile", string(opts.Profile))
+	}
+	if opts.QueryContext != "" {
+		v.Set("query_context", opts.QueryContext)
+	}
+	if opts.ClientContextID != "" {
+		v.Set("client_context_id", opts.ClientContextID)
+	}
+	return nil
+}
+
+type queryOptionsKey struct{}
+
+// WithQueryOptions returns a context whose requests use the given options,
+// over those of the connector and of any parent context. The options are
+// checked when a request is made.
+func WithQueryOptions(ctx context.Context, opts QueryOptions) context.Context {
+	if parent, ok := ctx.Value(queryOptionsKey{}).(QueryOptions); ok {
+		opts = parent.merge(opts)
+	}
+	return context.WithValue(ctx, queryOptionsKey{}, opts)
+}
+
+// Options of connections opened through sql.Open, guarded by the same lock
+// as QueryParams
+var queryOptions QueryOptions
+
+// guards QueryParams and queryOptions
+var queryParamsLock sync.RWMutex
+
+// SetQueryOptions sets the options of the requests of connections opened
+// through sql.Open
+func SetQueryOptions(opts QueryOptions) error {
+	if err := opts.validateShared(); err != nil {
+		return err
+	}
+
+	queryParamsLock.Lock()
+	defer queryParamsLock.Unlock()
+	queryOptions = opts
+	return nil
+}
+
+// Set the options for a request made with ctx, and return the
+// ConsistentWith of the request if any
+func (conn *n1qlConn) setQueryOptions(ctx context.Context, v *url.Values) (*ConsistentWith, error) {
+	opts := conn.cfg.QueryOptions
+	if conn.globals {
+		queryParamsLock.RLock()
+		opts = queryOptions
+		queryParamsLock.RUnlock()
+	}
+
+	if over, ok := ctx.Value(queryOptionsKey{}).(QueryOptions); ok {
+		if err := over.validate(); err != nil {
+			return nil, err
+		}
+		opts = opts.merge(over)
+	}
+
+	if err := opts.setValues(v); err != nil {
+		return nil, err
+	}
+
+	if queryContext, ok := ctx.Value(queryContextKey{}).(string); ok {
+		if queryContext == "" {
+			v.Del("query_context")
+		} else {
+			v.Set("query_context", queryContext)
+		}
+	}
+	return opts.ConsistentWith, nil
+}
+
+// The query context of requests made with ctx, if any
+func (conn *n1qlConn) queryContext(ctx context.Context) (string, error) {
+	v := url.Values{}
+	setQueryParams(&v, conn.queryParams())
+	if _, err := conn.setQueryOptions(ctx, &v); err != nil {
+		return "", err
+	}
+	return v.Get("query_context"), nil
+}
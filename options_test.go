@@ -0,0 +1,113 @@
+//  Copyright 2014-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package go_n1ql
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestQueryOptions(t *testing.T) {
+	var form url.Values
+	srv := fakeQueryService(t, func(r *http.Request) string {
+		form = r.Form
+		return `{"signature": {"id": "number"}, "results": [{"id": 1}], "status": "success"}`
+	})
+	defer srv.Close()
+
+	readonly := true
+	connector, err := NewConnector(Config{
+		Endpoint:    srv.URL,
+		QueryParams: map[string]string{"scan_consistency": "not_bounded", "pretty": "false"},
+		QueryOptions: QueryOptions{
+			ScanConsistency: RequestPlus,
+			ScanWait:        500 * time.Millisecond,
+			Readonly:        &readonly,
+			Raw:             map[string]interface{}{"named_args": map[string]int{"a": 1}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	query := func(ctx context.Context) {
+		var id int
+		if err := db.QueryRowContext(ctx, "select id from b").Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expect := func(step string, values map[string]string) {
+		for key, value := range values {
+			if form.Get(key) != value {
+				t.Fatalf("%s: expected %s=%q got %q", step, key, value, form.Get(key))
+			}
+		}
+	}
+
+	// the options of the connector override its query parameters
+	query(context.Background())
+	expect("connector", map[string]string{
+		"scan_consistency": "request_plus",
+		"scan_wait":        "500ms",
+		"readonly":         "true",
+		"named_args":       `{"a":1}`,
+		"pretty":           "false",
+	})
+
+	// and those of the context override both
+	useReplica := false
+	ctx := WithQueryOptions(context.Background(), QueryOptions{ScanConsistency: NotBounded, UseReplica: &useReplica})
+	ctx = WithQueryOptions(ctx, QueryOptions{ClientContextID: "mine", Timeout: time.Minute})
+	query(ctx)
+	expect("context", map[string]string{
+		"scan_consistency":  "not_bounded",
+		"scan_wait":         "500ms",
+		"use_replica":       "off",
+		"client_context_id": "mine",
+		"timeout":           "1m0s",
+	})
+
+	// invalid options are reported without sending the request
+	form = nil
+	ctx = WithQueryOptions(context.Background(), QueryOptions{ScanConsistency: "rubbish_plus"})
+	if err := db.QueryRowContext(ctx, "select id from b").Scan(new(int)); err == nil {
+		t.Fatal("Expected error for invalid scan consistency")
+	}
+	if form != nil {
+		t.Fatal("Request sent with invalid options")
+	}
+
+	if _, err := NewConnector(Config{Endpoint: srv.URL, QueryOptions: QueryOptions{MaxParallelism: -1}}); err == nil {
+		t.Fatal("Expected error for negative max parallelism")
+	}
+
+	// the statement and its arguments cannot be replaced
+	for _, key := range []string{"statement", "args", "prepared", "client_context_id", "$name"} {
+		form = nil
+		ctx = WithQueryOptions(context.Background(), QueryOptions{Raw: map[string]interface{}{key: "x"}})
+		if err := db.QueryRowContext(ctx, "select id from b").Scan(new(int)); err == nil || form != nil {
+			t.Fatalf("Expected error for raw option %s", key)
+		}
+	}
+
+	// a client context id shared by requests would cancel them all
+	if _, err := NewConnector(Config{Endpoint: srv.URL, QueryOptions: QueryOptions{ClientContextID: "mine"}}); err == nil {
+		t.Fatal("Expected error for client context id of the connector")
+	}
+	if err := SetQueryOptions(QueryOptions{ClientContextID: "mine"}); err == nil {
+		t.Fatal("Expected error for global client context id")
+	}
+}
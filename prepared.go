@@ -0,0 +1,378 @@
+//  Copyright 2014-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package go_n1ql
+
+import (
+	"container/list"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Number of prepared statements kept by a connector, so that preparing
+// the same statement again on any of its connections needs no round trip.
+// Zero or negative values disable the cache.
+var N1QL_PREPARED_CACHE_SIZE = 256
+
+// How long deleting a prepared statement from a query node may take
+var N1QL_DELETE_PREPARED_TIMEOUT = 5 * time.Second
+
+// Errors telling that the query service does not know a prepared statement
+// or that its plan is no longer valid, for example because an index it uses
+// was dropped. Statements failing with these are prepared again.
+var repreparedCodes = []int{4040, 4050, 4060, 4070, 4080, 4090, 12016}
+
+// N1QLConnector is implemented by the connectors of the driver
+type N1QLConnector interface {
+	driver.Connector
+
+	// Counters of the prepared statement cache of the connector
+	PreparedStats() PreparedStats
+
+	// Close deletes the statements prepared through the connector from
+	// the query nodes. sql.DB.Close calls it.
+	io.Closer
+}
+
+// PreparedStats are the counters of a prepared statement cache
+type PreparedStats struct {
+	// Statements found in the cache and statements that had to be prepared
+	Hits   uint64
+	Misses uint64
+
+	// Statements dropped from the cache to make room for others
+	Evictions uint64
+
+	// Statements prepared again because the query service no longer
+	// knew them or their plan was stale
+	Reprepares uint64
+}
+
+// A statement prepared by the query service. Statements prepared with the
+// same text share it. The driver names it, so that it can be prepared
+// under the same name on each query node it is sent to, the first time
+// it is. It is deleted from the nodes once the statements using it and
+// the cache no longer refer to it.
+type preparedStatement struct {
+	query        string
+	queryContext string
+	params       statementParams
+
+	lock  sync.RWMutex
+	name  string
+	nodes map[string]bool
+	refs  int
+}
+
+func (p *preparedStatement) acquire() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.refs++
+}
+
+// Drop a reference, and return whether that was the last one
+func (p *preparedStatement) release() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.refs--
+	return p.refs == 0
+}
+
+// Delete the statement from the query nodes it was prepared on. It is
+// prepared again if it is executed after that.
+func (conn *n1qlConn) deletePrepared(p *preparedStatement) error {
+	p.lock.Lock()
+	name, nodes := p.name, p.nodes
+	p.nodes = make(map[string]bool)
+	p.lock.Unlock()
+
+	if conn.prepareds != nil {
+		conn.prepareds.forget(p)
+	}
+	return conn.deletePreparedName(name, nodes)
+}
+
+// Delete the statement with the given name from the nodes, returning the
+// first error if any
+func (conn *n1qlConn) deletePreparedName(name string, nodes map[string]bool) error {
+	var firstErr error
+	for node := range nodes {
+		if err := conn.deletePreparedOn(name, node); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (conn *n1qlConn) deletePreparedOn(name, node string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), N1QL_DELETE_PREPARED_TIMEOUT)
+	defer cancel()
+
+	requestValues, err := conn.statementValues("DELETE FROM system:prepareds WHERE name = $name",
+		[]driver.NamedValue{{Name: "name", Value: name}})
+	if err != nil {
+		return err
+	}
+
+	request, err := conn.newQueryRequest(ctx, node, requestValues)
+	if err != nil {
+		return err
+	}
+
+	resp, err := conn.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("N1QL: Failed to delete prepared statement %s. Error %v", name, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("N1QL: Failed to delete prepared statement %s %w", name, responseError(resp))
+	}
+
+	var resultMap map[string]*json.RawMessage
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, N1QL_MAX_ERROR_BYTES))
+	if err == nil && json.Unmarshal(body, &resultMap) == nil && resultMap["errors"] != nil {
+		errs := decodeErrors(resultMap["errors"], decodeRequestID(resultMap["requestID"]), resp.StatusCode)
+		return fmt.Errorf("N1QL: Failed to delete prepared statement %s %w", name, errs)
+	}
+	return nil
+}
+
+// Statements are cached per query context, in which the names of keyspaces
+// in them are resolved
+func preparedKey(query, queryContext string) string {
+	return queryContext + "\x00" + query
+}
+
+type queryContextKey struct{}
+
+// A context whose requests are made in the given query context, whatever
+// the query options say. Statements are prepared and executed in the query
+// context they were first prepared in.
+func withQueryContext(ctx context.Context, queryContext string) context.Context {
+	return context.WithValue(ctx, queryContextKey{}, queryContext)
+}
+
+// Names of the statements prepared by the driver
+func newPreparedName() string {
+	return "go_n1ql_" + randomID()
+}
+
+// whether err says that a prepared statement has to be prepared again
+func isStalePrepared(err error) bool {
+	for _, code := range repreparedCodes {
+		if errors.Is(err, &N1QLError{Code: code}) {
+			return true
+		}
+	}
+	return false
+}
+
+// An execution of a prepared statement. The name it was executed with and
+// the node it was sent to are set when the request is sent.
+type execution struct {
+	prepared *preparedStatement
+	name     string
+	node     string
+}
+
+type executionKey struct{}
+
+func withExecution(ctx context.Context, exec *execution) context.Context {
+	return context.WithValue(ctx, executionKey{}, exec)
+}
+
+// the execution of a prepared statement requests made with ctx are for, if any
+func executionOf(ctx context.Context) *execution {
+	exec, _ := ctx.Value(executionKey{}).(*execution)
+	return exec
+}
+
+// Prepare the statement of exec on the node unless it has been already, and
+// return its name
+func (conn *n1qlConn) prepareOn(ctx context.Context, exec *execution, node string) (string, error) {
+	p := exec.prepared
+	exec.node = node
+
+	p.lock.RLock()
+	name, known := p.name, p.nodes[node]
+	p.lock.RUnlock()
+
+	exec.name = name
+	if known {
+		return name, nil
+	}
+
+	// the preparation itself is not an execution, and has to go to the node
+	ctx = WithNode(withExecution(ctx, nil), node)
+	if _, err := conn.prepareNamed(ctx, name, p.query); err != nil {
+		return "", err
+	}
+
+	p.lock.Lock()
+	if p.name == name {
+		p.nodes[node] = true
+	}
+	p.lock.Unlock()
+	return name, nil
+}
+
+// Executing a statement failed with err, which says that it has to be
+// prepared again. If the node it was sent to no longer knows it, it was
+// restarted and only that node is affected, otherwise the plan is stale
+// and the statement is prepared again under a new name on every node.
+// The stale one is deleted.
+func (conn *n1qlConn) reprepare(exec *execution, err error) {
+	p := exec.prepared
+
+	p.lock.Lock()
+
+	// some other execution got there first
+	if p.name != exec.name {
+		p.lock.Unlock()
+		return
+	}
+
+	var stale map[string]bool
+	if errors.Is(err, &N1QLError{Code: 4040}) {
+		delete(p.nodes, exec.node)
+	} else {
+		stale = p.nodes
+		p.name = newPreparedName()
+		p.nodes = make(map[string]bool)
+	}
+	p.lock.Unlock()
+
+	if conn.prepareds != nil {
+		atomic.AddUint64(&conn.prepareds.reprepares, 1)
+	}
+	conn.deletePreparedName(exec.name, stale)
+}
+
+// LRU cache of prepared statements keyed by statement text, shared by the
+// connections of a connector. It also keeps track of all the statements
+// prepared through the connector, so that they can be deleted when it is
+// closed.
+type preparedCache struct {
+	lock    sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List
+	live    map[*preparedStatement]bool
+
+	hits       uint64
+	misses     uint64
+	evictions  uint64
+	reprepares uint64
+}
+
+type preparedEntry struct {
+	query    string
+	prepared *preparedStatement
+}
+
+// a cache of the given size. Zero or negative sizes disable caching.
+func newPreparedCache(size int) *preparedCache {
+	return &preparedCache{size: size,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		live:    make(map[*preparedStatement]bool),
+	}
+}
+
+// Look up a statement, taking a reference to it if found
+func (cache *preparedCache) get(query string) (*preparedStatement, bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	elem, ok := cache.entries[query]
+	if !ok {
+		cache.misses++
+		return nil, false
+	}
+	cache.hits++
+	cache.lru.MoveToFront(elem)
+
+	prepared := elem.Value.(*preparedEntry).prepared
+	prepared.acquire()
+	return prepared, true
+}
+
+// Add a new statement, with a reference held by the cache. Returns the
+// statements the cache no longer refers to, which have to be released.
+func (cache *preparedCache) put(query string, prepared *preparedStatement) []*preparedStatement {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	cache.live[prepared] = true
+	if cache.size <= 0 {
+		return nil
+	}
+
+	var released []*preparedStatement
+	prepared.acquire()
+	if elem, ok := cache.entries[query]; ok {
+		entry := elem.Value.(*preparedEntry)
+		released = append(released, entry.prepared)
+		entry.prepared = prepared
+		cache.lru.MoveToFront(elem)
+		return released
+	}
+
+	cache.entries[query] = cache.lru.PushFront(&preparedEntry{query: query, prepared: prepared})
+	for cache.lru.Len() > cache.size {
+		oldest := cache.lru.Back()
+		cache.lru.Remove(oldest)
+		entry := oldest.Value.(*preparedEntry)
+		delete(cache.entries, entry.query)
+		released = append(released, entry.prepared)
+		cache.evictions++
+	}
+	return released
+}
+
+// stop tracking a statement that has been deleted
+func (cache *preparedCache) forget(prepared *preparedStatement) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	delete(cache.live, prepared)
+}
+
+// Empty the cache and return all the statements that have not been deleted
+func (cache *preparedCache) drain() []*preparedStatement {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	live := make([]*preparedStatement, 0, len(cache.live))
+	for prepared := range cache.live {
+		live = append(live, prepared)
+	}
+	cache.entries = make(map[string]*list.Element)
+	cache.lru.Init()
+	cache.live = make(map[*preparedStatement]bool)
+	return live
+}
+
+func (cache *preparedCache) stats() PreparedStats {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	return PreparedStats{
+		Hits:       cache.hits,
+		Misses:     cache.misses,
+		Evictions:  cache.evictions,
+		Reprepares: atomic.LoadUint64(&cache.reprepares),
+	}
+}
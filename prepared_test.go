@@ -0,0 +1,412 @@
+//  Copyright 2014-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package go_n1ql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestPreparedCache(t *testing.T) {
+	var lock sync.Mutex
+	prepares := 0
+	known := map[string]bool{}
+
+	srv := fakeQueryService(t, func(r *http.Request) string {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if statement := r.Form.Get("statement"); strings.HasPrefix(statement, "PREPARE") {
+			prepares++
+			name := strings.Fields(statement)[1]
+			known[`"`+name+`"`] = true
+			return `{"results": [{"name": "` + name + `", "operator": {}}], "status": "success"}`
+		}
+		if !known[r.Form.Get("prepared")] {
+			return `{"errors": [{"code": 4040, "msg": "No such prepared statement"}], "status": "fatal"}`
+		}
+		return `{"signature": {"id": "number"}, "results": [{"id": 1}], "status": "success"}`
+	})
+	defer srv.Close()
+
+	connector, err := NewConnector(Config{Endpoint: srv.URL, PreparedCacheSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	// database/sql prepares statements again on each connection they use
+	db.SetMaxOpenConns(1)
+
+	query := func(stmt *sql.Stmt) {
+		var id int
+		if err := stmt.QueryRow().Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the second statement is found in the cache
+	stmt1, err := db.Prepare("select id from b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt1.Close()
+	stmt2, err := db.Prepare("select id from b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt2.Close()
+	query(stmt1)
+	query(stmt2)
+
+	stats := connector.(N1QLConnector).PreparedStats()
+	if stats != (PreparedStats{Hits: 1, Misses: 1}) || prepares != 1 {
+		t.Fatalf("Unexpected stats %+v after %d prepares", stats, prepares)
+	}
+
+	// the query service restarted and lost its prepared statements, they
+	// are prepared again once for all the statements sharing them
+	lock.Lock()
+	known = map[string]bool{}
+	lock.Unlock()
+	query(stmt1)
+	query(stmt2)
+
+	stats = connector.(N1QLConnector).PreparedStats()
+	if stats.Reprepares != 1 || prepares != 2 {
+		t.Fatalf("Unexpected stats %+v after %d prepares", stats, prepares)
+	}
+
+	// exec prepares again too
+	lock.Lock()
+	known = map[string]bool{}
+	lock.Unlock()
+	if _, err := stmt1.ExecContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the least recently used statement is evicted
+	stmt3, err := db.Prepare("select id from c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt3.Close()
+
+	stats = connector.(N1QLConnector).PreparedStats()
+	if stats != (PreparedStats{Hits: 1, Misses: 2, Evictions: 1, Reprepares: 2}) {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+}
+
+// a query node knowing the statements prepared on it
+type fakeQueryNode struct {
+	lock     sync.Mutex
+	prepares int
+	known    map[string]bool
+	stale    bool
+	late     bool
+	deleted  []string
+}
+
+func (node *fakeQueryNode) handle(r *http.Request) string {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	if statement := r.Form.Get("statement"); strings.HasPrefix(statement, "PREPARE") {
+		node.prepares++
+		node.known[strings.Fields(statement)[1]] = true
+		return `{"results": [{"name": "` + strings.Fields(statement)[1] + `"}], "status": "success"}`
+	} else if strings.HasPrefix(statement, "DELETE FROM system:prepareds") {
+		name := strings.Trim(r.Form.Get("$name"), `"`)
+		delete(node.known, name)
+		node.deleted = append(node.deleted, name)
+		return `{"results": [], "status": "success", "metrics": {"mutationCount": 1}}`
+	}
+
+	name := strings.Trim(r.Form.Get("prepared"), `"`)
+	switch {
+	case !node.known[name]:
+		return `{"errors": [{"code": 4040, "msg": "No such prepared statement"}], "status": "fatal"}`
+	case node.stale && node.late:
+		node.stale = false
+		return `{"signature": {"id": "number"}, "results": [], "errors": [{"code": 12016, "msg": "Index not found"}], "status": "fatal"}`
+	case node.stale:
+		node.stale = false
+		return `{"errors": [{"code": 12016, "msg": "Index not found"}], "status": "fatal"}`
+	}
+	return `{"signature": {"id": "number"}, "results": [{"id": 1}], "status": "success"}`
+}
+
+// the node loses its prepared statements
+func (node *fakeQueryNode) restart() {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	node.known = map[string]bool{}
+}
+
+// the plans of the node are stale, as if an index had been dropped. The
+// error is reported either on its own or, as when the index is found
+// missing during execution, after the results.
+func (node *fakeQueryNode) invalidate(afterResults bool) {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	node.stale = true
+	node.late = afterResults
+}
+
+func TestPreparedNodes(t *testing.T) {
+	nodeA := &fakeQueryNode{known: map[string]bool{}}
+	nodeB := &fakeQueryNode{known: map[string]bool{}}
+	srvA := fakeQueryService(t, nodeA.handle)
+	defer srvA.Close()
+	srvB := fakeQueryService(t, nodeB.handle)
+	defer srvB.Close()
+
+	connector, err := NewConnector(Config{Endpoint: srvA.URL, NodeSelector: NewRoundRobinSelector()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := connector.Connect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	conn := c.(*n1qlConn)
+	conn.topology.queryAPIs = []string{srvA.URL + N1QL_SERVICE_ENDPOINT, srvB.URL + N1QL_SERVICE_ENDPOINT}
+
+	stmt, err := conn.PrepareContext(context.Background(), "select id from b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+
+	query := func() {
+		rows, err := stmt.(driver.StmtQueryContext).QueryContext(context.Background(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows.Close()
+	}
+
+	expect := func(step string, a, b int) {
+		nodeA.lock.Lock()
+		defer nodeA.lock.Unlock()
+		nodeB.lock.Lock()
+		defer nodeB.lock.Unlock()
+		if nodeA.prepares != a || nodeB.prepares != b {
+			t.Fatalf("%s: expected %d and %d prepares got %d and %d", step, a, b, nodeA.prepares, nodeB.prepares)
+		}
+	}
+
+	// the statement is prepared on each node the first time it goes there
+	expect("prepare", 1, 0)
+	for i := 0; i < 4; i++ {
+		query()
+	}
+	expect("executions", 1, 1)
+
+	// a node that restarted gets it again
+	nodeB.restart()
+	for i := 0; i < 4; i++ {
+		query()
+	}
+	expect("restart", 1, 2)
+
+	// a stale plan is prepared again on every node
+	nodeA.invalidate(false)
+	for i := 0; i < 4; i++ {
+		query()
+	}
+	expect("stale plan", 2, 3)
+
+	// also when found stale during execution
+	nodeB.invalidate(true)
+	for i := 0; i < 4; i++ {
+		query()
+	}
+	expect("stale plan after results", 3, 4)
+
+	// a node that cannot be reached to prepare the statement is dropped
+	// and the statement sent to another one
+	srvC := httptest.NewServer(http.NotFoundHandler())
+	srvC.Close()
+	nodeC := srvC.URL + N1QL_SERVICE_ENDPOINT
+	conn.topology.queryAPIs = []string{srvA.URL + N1QL_SERVICE_ENDPOINT, srvB.URL + N1QL_SERVICE_ENDPOINT, nodeC}
+	for i := 0; i < 6; i++ {
+		query()
+	}
+	for _, node := range conn.topology.nodes() {
+		if node == nodeC {
+			t.Fatalf("Dead node %s still in use", nodeC)
+		}
+	}
+}
+
+func TestPreparedCleanup(t *testing.T) {
+	node := &fakeQueryNode{known: map[string]bool{}}
+	srv := fakeQueryService(t, node.handle)
+	defer srv.Close()
+
+	prepare := func(db *sql.DB, query string) (*sql.Stmt, string) {
+		stmt, err := db.Prepare(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var id int
+		if err := stmt.QueryRow().Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+
+		node.lock.Lock()
+		defer node.lock.Unlock()
+		for name := range node.known {
+			return stmt, name
+		}
+		t.Fatalf("Statement %s not prepared", query)
+		return nil, ""
+	}
+
+	expect := func(step string, deleted ...string) {
+		node.lock.Lock()
+		defer node.lock.Unlock()
+		if len(node.deleted) != len(deleted) || (len(deleted) > 0 && !reflect.DeepEqual(node.deleted, deleted)) {
+			t.Fatalf("%s: expected %v to be deleted got %v", step, deleted, node.deleted)
+		}
+	}
+
+	// without a cache, statements are deleted when closed
+	connector, err := NewConnector(Config{Endpoint: srv.URL, PreparedCacheSize: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	db.SetMaxOpenConns(1)
+
+	stmt, name := prepare(db, "select id from a")
+	expect("open statement")
+	stmt.Close()
+	expect("closed statement", name)
+	db.Close()
+
+	// cached statements are deleted once evicted and no longer used
+	node.deleted = nil
+	connector, err = NewConnector(Config{Endpoint: srv.URL, PreparedCacheSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = sql.OpenDB(connector)
+	db.SetMaxOpenConns(1)
+
+	stmtA, nameA := prepare(db, "select id from a")
+	stmtA.Close()
+	expect("cached statement")
+
+	stmtB, nameB := prepare(db, "select id from b")
+	expect("evicted statement", nameA)
+
+	// and all of them when the database is closed
+	stmtB2, err := db.Prepare("select id from b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stmtB2.Close()
+	expect("shared statement", nameA)
+
+	stmtB.Close()
+	db.Close()
+	expect("closed database", nameA, nameB)
+}
+
+func TestPreparedQueryContext(t *testing.T) {
+	var lock sync.Mutex
+	contexts := map[string][]string{}
+
+	record := func(node *fakeQueryNode) func(r *http.Request) string {
+		return func(r *http.Request) string {
+			name := strings.Trim(r.Form.Get("prepared"), `"`)
+			if statement := r.Form.Get("statement"); strings.HasPrefix(statement, "PREPARE") {
+				name = strings.Fields(statement)[1]
+			}
+			lock.Lock()
+			contexts[name] = append(contexts[name], r.Form.Get("query_context"))
+			lock.Unlock()
+			return node.handle(r)
+		}
+	}
+
+	nodeA := &fakeQueryNode{known: map[string]bool{}}
+	nodeB := &fakeQueryNode{known: map[string]bool{}}
+	srvA := fakeQueryService(t, record(nodeA))
+	defer srvA.Close()
+	srvB := fakeQueryService(t, record(nodeB))
+	defer srvB.Close()
+
+	connector, err := NewConnector(Config{Endpoint: srvA.URL, NodeSelector: NewRoundRobinSelector()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := connector.Connect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	conn := c.(*n1qlConn)
+	conn.topology.queryAPIs = []string{srvA.URL + N1QL_SERVICE_ENDPOINT, srvB.URL + N1QL_SERVICE_ENDPOINT}
+
+	prepare := func(queryContext string) *n1qlStmt {
+		ctx := WithQueryOptions(context.Background(), QueryOptions{QueryContext: queryContext})
+		stmt, err := conn.PrepareContext(ctx, "select id from b")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stmt.(*n1qlStmt)
+	}
+
+	// the same statement in different query contexts is prepared for each
+	stmtA := prepare("default:a.s")
+	defer stmtA.Close()
+	stmtB := prepare("default:b.s")
+	defer stmtB.Close()
+	stmtA2 := prepare("default:a.s")
+	defer stmtA2.Close()
+	if stmtA.prepared == stmtB.prepared || stmtA.prepared != stmtA2.prepared {
+		t.Fatal("Expected statements to be shared within a query context only")
+	}
+
+	// and prepared on other nodes in its own query context, whatever the
+	// context of the execution
+	ctx := WithQueryOptions(context.Background(), QueryOptions{QueryContext: "default:c.s"})
+	for i := 0; i < 4; i++ {
+		rows, err := stmtA.QueryContext(ctx, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows.Close()
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	sent := contexts[stmtA.prepared.name]
+	if len(sent) != 6 {
+		t.Fatalf("Expected 2 prepares and 4 executions got %v", sent)
+	}
+	for _, queryContext := range sent {
+		if queryContext != "default:a.s" {
+			t.Fatalf("Expected query context default:a.s got %v", sent)
+		}
+	}
+}
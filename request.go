@@ -0,0 +1,214 @@
+//  Copyright 2014-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package go_n1ql
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// defaults
+var (
+	N1QL_ACTIVE_REQUESTS_ENDPOINT = "/admin/active_requests"
+	N1QL_CANCEL_TIMEOUT           = 5 * time.Second
+)
+
+// RequestCancelledError is returned when a request is abandoned because
+// its context was cancelled or its deadline expired. Err is the context
+// error, CancelErr is nil if the query service stopped the request and
+// otherwise says why it could not be stopped.
+type RequestCancelledError struct {
+	ClientContextID string
+	Err             error
+	CancelErr       error
+}
+
+func (e *RequestCancelledError) Error() string {
+	if e.CancelErr != nil {
+		return fmt.Sprintf("N1QL: Request %s abandoned: %v. Cancel failed: %v", e.ClientContextID, e.Err, e.CancelErr)
+	}
+	return fmt.Sprintf("N1QL: Request %s cancelled: %v", e.ClientContextID, e.Err)
+}
+
+func (e *RequestCancelledError) Unwrap() error {
+	return e.Err
+}
+
+// a request sent to a query node
+type n1qlRequest struct {
+	ctx             context.Context
+	conn            *n1qlConn
+	queryAPI        string
+	clientContextID string
+	statement       string
+	selector        NodeSelector
+	latency         time.Duration
+	completed       int32
+
+	// the ConsistentWith a DML statement was sent with, until its outcome
+	// is recorded
+	consistentWith *ConsistentWith
+	recorded       int32
+}
+
+// Tell the node selector, if any, that the request has completed. err is
+// the error if the node could not be reached.
+func (req *n1qlRequest) complete(err error) {
+	if req.selector != nil && atomic.CompareAndSwapInt32(&req.completed, 0, 1) {
+		req.selector.Done(req.queryAPI, req.latency, err)
+	}
+}
+
+// The request is about to be sent. A DML statement is taken to change
+// documents from then on, so that the requests made with the same
+// ConsistentWith see the changes.
+func (req *n1qlRequest) sending(consistentWith *ConsistentWith) {
+	if consistentWith != nil && isMutation(req.statement) {
+		req.consistentWith = consistentWith
+		consistentWith.mutating()
+	}
+}
+
+// Record the outcome of a DML statement once. known says whether the whole
+// response was read, in which case mutations is the number it reported.
+func (req *n1qlRequest) recordMutations(mutations int64, known bool) {
+	if req.consistentWith != nil && atomic.CompareAndSwapInt32(&req.recorded, 0, 1) {
+		req.consistentWith.mutated(!known || mutations > 0)
+	}
+}
+
+// Record the outcome of a DML statement from the metrics of its response,
+// once the response has been read
+func (req *n1qlRequest) recordResponse(metrics *json.RawMessage) {
+	if metrics == nil {
+		req.recordMutations(0, false)
+		return
+	}
+	m, err := decodeMetrics(metrics)
+	req.recordMutations(m.MutationCount, err == nil)
+}
+
+// Decode the warnings field of a response and pass the warnings to the
+// warning handler of the connection, if any
+func (req *n1qlRequest) warned(warnings *json.RawMessage, requestID string) []N1QLWarning {
+	if warnings == nil {
+		return nil
+	}
+	warns := decodeWarnings(warnings, requestID)
+	if handler := req.conn.cfg.WarningHandler; handler != nil && len(warns) > 0 {
+		handler(req.statement, warns)
+	}
+	return warns
+}
+
+// Returns the error to report for a failure while the request was
+// outstanding. If the caller gave up, the request is cancelled on the
+// query node so that it does not keep running.
+func (req *n1qlRequest) failed(err error) error {
+	if req.ctx.Err() == nil {
+		return err
+	}
+	return &RequestCancelledError{
+		ClientContextID: req.clientContextID,
+		Err:             req.ctx.Err(),
+		CancelErr:       req.conn.cancelRequest(req.queryAPI, req.clientContextID),
+	}
+}
+
+// set a client context id on the request unless one was given, and return it
+func setClientContextID(v *url.Values) string {
+	if id := v.Get("client_context_id"); id != "" {
+		return id
+	}
+
+	id := randomID()
+	v.Set("client_context_id", id)
+	return id
+}
+
+// random hex string, unique enough to tell requests and statements apart
+func randomID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		b = [16]byte{}
+		copy(b[:], fmt.Sprintf("%x", time.Now().UnixNano()))
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// Cancel all the requests with the given client context id that are active
+// on the query node serving queryAPI
+func (conn *n1qlConn) cancelRequest(queryAPI, clientContextID string) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), N1QL_CANCEL_TIMEOUT)
+	defer cancel()
+
+	adminAPI := strings.TrimSuffix(queryAPI, N1QL_SERVICE_ENDPOINT) + N1QL_ACTIVE_REQUESTS_ENDPOINT
+	request, err := conn.newRequest(ctx, "GET", adminAPI, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := conn.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		bod, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s", bod)
+	}
+
+	var activeRequests []struct {
+		RequestId       string `json:"requestId"`
+		ClientContextID string `json:"clientContextID"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&activeRequests); err != nil {
+		return fmt.Errorf("N1QL: Failed to parse active requests. Error %v", err)
+	}
+
+	found := false
+	for _, ar := range activeRequests {
+		if ar.ClientContextID != clientContextID {
+			continue
+		}
+		found = true
+
+		request, err := conn.newRequest(ctx, "DELETE", adminAPI+"/"+url.PathEscape(ar.RequestId), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := conn.client.Do(request)
+		if err != nil {
+			return err
+		}
+		bod, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+
+		// the request may have completed in the meantime
+		if resp.StatusCode != 200 && resp.StatusCode != 404 {
+			return fmt.Errorf("%s", bod)
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("N1QL: Request not found on %s", adminAPI)
+	}
+	return nil
+}
@@ -8,9 +8,27 @@
 
 package go_n1ql
 
+import (
+	"database/sql/driver"
+)
+
+// N1QLResult is implemented by the results of the driver. They can be
+// obtained through sql.Conn.Raw by executing statements on the driver
+// connection.
+type N1QLResult interface {
+	driver.Result
+
+	// Warnings reported by the query service for the statement
+	Warnings() []N1QLWarning
+
+	// Metadata of the request
+	Metadata() N1QLMetadata
+}
+
 type n1qlResult struct {
 	affectedRows int64
 	insertId     int64
+	metadata     N1QLMetadata
 }
 
 func (res *n1qlResult) LastInsertId() (int64, error) {
@@ -20,3 +38,11 @@ func (res *n1qlResult) LastInsertId() (int64, error) {
 func (res *n1qlResult) RowsAffected() (int64, error) {
 	return res.affectedRows, nil
 }
+
+func (res *n1qlResult) Warnings() []N1QLWarning {
+	return res.metadata.Warnings
+}
+
+func (res *n1qlResult) Metadata() N1QLMetadata {
+	return res.metadata
+}
@@ -0,0 +1,171 @@
+//  Copyright 2014-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package go_n1ql
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// RetryPolicy says how failed requests are retried. A request is retried
+// if no query node could be reached, and for statements that can safely
+// be run again also if the connection failed, the query service was
+// unavailable or it reported an error that can be retried.
+//
+// Statements starting with SELECT, EXPLAIN, ADVISE, INFER or PREPARE can
+// be run again. Others, such as DML, are only retried if the request did
+// not reach the query service, unless WithIdempotent says otherwise.
+type RetryPolicy struct {
+	// Number of attempts, including the first one
+	MaxAttempts int
+
+	// Time after which no further attempts are made, if set
+	MaxDuration time.Duration
+
+	// Wait before the first retry, multiplied by Multiplier for each
+	// further retry up to MaxBackoff. Multiplier defaults to 2.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+
+	// Fraction of the wait that is random, from 0 to 1
+	Jitter float64
+}
+
+// DefaultRetryPolicy is a reasonable policy for most applications
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	MaxDuration:    10 * time.Second,
+	InitialBackoff: 100 * time.Millisecond,
+	MaxBackoff:     2 * time.Second,
+	Multiplier:     2,
+	Jitter:         0.2,
+}
+
+// Policy of connections opened through sql.Open, no retries if nil
+var N1QL_RETRY_POLICY *RetryPolicy
+
+func SetRetryPolicy(policy *RetryPolicy) {
+	N1QL_RETRY_POLICY = policy
+}
+
+// wait before the given retry, starting from 1
+func (policy *RetryPolicy) backoff(retry int) time.Duration {
+	multiplier := policy.Multiplier
+	if multiplier <= 0 {
+		multiplier = 2
+	}
+
+	backoff := float64(policy.InitialBackoff) * math.Pow(multiplier, float64(retry-1))
+	if policy.MaxBackoff > 0 && backoff > float64(policy.MaxBackoff) {
+		backoff = float64(policy.MaxBackoff)
+	}
+	if policy.Jitter > 0 {
+		backoff -= backoff * policy.Jitter * rand.Float64()
+	}
+	return time.Duration(backoff)
+}
+
+type idempotentKey struct{}
+
+// WithIdempotent returns a context marking the statements run with it as
+// safe to run more than once, so that they are retried like queries.
+func WithIdempotent(ctx context.Context) context.Context {
+	return context.WithValue(ctx, idempotentKey{}, true)
+}
+
+// whether statement can be run more than once
+func isIdempotent(ctx context.Context, statement string) bool {
+	if marked, _ := ctx.Value(idempotentKey{}).(bool); marked {
+		return true
+	}
+	switch statementKeyword(statement) {
+	case "SELECT", "EXPLAIN", "ADVISE", "INFER", "PREPARE":
+		return true
+	}
+	return false
+}
+
+// whether err is the failure to connect to a query node, in which case the
+// request was never sent
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// whether a request that failed with err can be retried
+func retriable(err error, idempotent bool) bool {
+	if isDialError(err) {
+		return true
+	}
+	if !idempotent {
+		return false
+	}
+
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return true
+	}
+
+	var n1qlErrs N1QLErrors
+	if errors.As(err, &n1qlErrs) {
+		for _, e := range n1qlErrs {
+			if e.Retry || e.HTTPStatus == http.StatusServiceUnavailable {
+				return true
+			}
+		}
+		return false
+	}
+
+	var n1qlErr *N1QLError
+	return errors.As(err, &n1qlErr) && (n1qlErr.Retry || n1qlErr.HTTPStatus == http.StatusServiceUnavailable)
+}
+
+func (conn *n1qlConn) retryPolicy() *RetryPolicy {
+	if conn.globals {
+		return N1QL_RETRY_POLICY
+	}
+	return conn.cfg.RetryPolicy
+}
+
+// Run do for statement, retrying it as the retry policy allows
+func (conn *n1qlConn) retry(ctx context.Context, statement string, do func() error) error {
+	policy := conn.retryPolicy()
+	if policy == nil {
+		return do()
+	}
+
+	idempotent := isIdempotent(ctx, statement)
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		err := do()
+		if err == nil || attempt >= policy.MaxAttempts || ctx.Err() != nil || !retriable(err, idempotent) {
+			return err
+		}
+
+		backoff := policy.backoff(attempt)
+		if policy.MaxDuration > 0 && time.Since(start)+backoff > policy.MaxDuration {
+			return err
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
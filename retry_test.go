@@ -0,0 +1,111 @@
+//  Copyright 2014-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package go_n1ql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	var lock sync.Mutex
+	attempts := map[string]int{}
+
+	// every statement fails twice before succeeding
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		statement := r.Form.Get("statement")
+		if statement == N1QL_DEFAULT_STATEMENT {
+			fmt.Fprint(w, `{"results": [{"$1": 1}], "status": "success"}`)
+			return
+		}
+
+		lock.Lock()
+		attempts[statement]++
+		attempt := attempts[statement]
+		lock.Unlock()
+
+		switch {
+		case attempt > 2:
+			fmt.Fprint(w, `{"results": [{"$1": 1}], "status": "success", "metrics": {"mutationCount": 1}}`)
+		case statement == "select retry flag":
+			fmt.Fprint(w, `{"errors": [{"code": 1080, "msg": "Timeout", "retry": true}], "status": "errors"}`)
+		case statement == "select retry after results":
+			// errors during execution follow the results
+			fmt.Fprint(w, `{"signature": {"$1": "number"}, "results": [], "errors": [{"code": 1080, "msg": "Timeout", "retry": true}], "status": "timeout"}`)
+		default:
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	policy := &RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, Jitter: 0.5}
+	connector, err := NewConnector(Config{Endpoint: srv.URL, RetryPolicy: policy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	tests := []struct {
+		statement  string
+		idempotent bool
+		attempts   int
+		fails      bool
+	}{
+		{"select unavailable", false, 3, false},
+		{"select retry flag", false, 3, false},
+		{"select retry after results", false, 3, false},
+		{"delete from b", false, 1, true},
+		{"update b set a = 1", true, 3, false},
+	}
+
+	for _, test := range tests {
+		ctx := context.Background()
+		if test.idempotent {
+			ctx = WithIdempotent(ctx)
+		}
+
+		var err error
+		if statementKeyword(test.statement) == "SELECT" {
+			var one int
+			err = db.QueryRowContext(ctx, test.statement).Scan(&one)
+		} else {
+			_, err = db.ExecContext(ctx, test.statement)
+		}
+		if (err != nil) != test.fails {
+			t.Errorf("%s: unexpected error %v", test.statement, err)
+		}
+
+		lock.Lock()
+		if attempts[test.statement] != test.attempts {
+			t.Errorf("%s: expected %d attempts got %d", test.statement, test.attempts, attempts[test.statement])
+		}
+		lock.Unlock()
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	policy := &RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second, Jitter: 0.2}
+
+	expected := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond,
+		800 * time.Millisecond, time.Second, time.Second}
+	for i, max := range expected {
+		backoff := policy.backoff(i + 1)
+		if backoff > max || backoff < max*8/10 {
+			t.Errorf("Retry %d: expected backoff between %v and %v got %v", i+1, max*8/10, max, backoff)
+		}
+	}
+}
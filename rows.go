@@ -9,163 +9,458 @@
 package go_n1ql
 
 import (
+	"context"
 	"database/sql/driver"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
-	"sort"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// N1QLRows is implemented by the rows returned by the driver. They can be
+// obtained through sql.Conn.Raw by querying the driver connection.
+type N1QLRows interface {
+	driver.Rows
+
+	// Warnings reported by the query service for the statement. These
+	// follow the results, so they are known once Next has returned io.EOF
+	// or an error.
+	Warnings() []N1QLWarning
+
+	// Metadata of the request. The status, metrics and profile follow the
+	// results as well, they are known once Next has returned io.EOF.
+	Metadata() N1QLMetadata
+}
+
+// Most of the response is not read yet when n1qlRows are returned, each
+// call to Next reads one more row. The lock serialises Next and Close.
 type n1qlRows struct {
+	lock        sync.Mutex
 	resp        *http.Response
-	results     io.Reader
-	resultChan  chan interface{}
-	errChan     chan error
-	closed      bool
+	stream      *resultStream
+	req         *n1qlRequest
+	ctx         context.Context
+	cancel      context.CancelFunc
+	pending     []json.RawMessage
+	eof         bool
+	done        bool
+	closing     int32
 	signature   interface{}
 	extras      interface{}
 	metrics     interface{}
 	errors      interface{}
+	warnings    []N1QLWarning
 	passthrough bool
 	columns     []string
 	rowsSent    int
+	rowsOptions
 }
 
-func resultToRows(results io.Reader, resp *http.Response, signature interface{}, metrics, errors, extraVals interface{}) (*n1qlRows, error) {
+type rowsOptions struct {
+	rawJSON       bool
+	reportMissing bool
+}
 
-	rows := &n1qlRows{results: results,
-		resp:       resp,
-		signature:  signature,
-		extras:     extraVals,
-		metrics:    metrics,
-		errors:     errors,
-		resultChan: make(chan interface{}, 1),
-		errChan:    make(chan error),
-	}
+// MissingValue is the type of Missing
+type MissingValue struct{}
 
-	// detect if we are in passthrough mode
-	if metrics != nil && extraVals != nil {
-		rows.passthrough = true
-	}
+func (m MissingValue) String() string {
+	return "MISSING"
+}
 
-	go rows.populateRows()
+// Missing is the value of a column whose field is absent from the result,
+// when MISSING values are reported. Otherwise both NULL and MISSING are
+// returned as nil. Missing can be scanned into an interface{} or a
+// JSONValue.
+var Missing = MissingValue{}
 
-	return rows, nil
+// JSONValue can be scanned from any column. It tells NULL and MISSING
+// apart when MISSING values are reported.
+type JSONValue struct {
+	Value   interface{}
+	Null    bool
+	Missing bool
 }
 
-func (rows *n1qlRows) populateRows() {
-	var resultRows []interface{}
-	defer rows.resp.Body.Close()
+func (v *JSONValue) Scan(src interface{}) error {
+	*v = JSONValue{}
+	switch src := src.(type) {
+	case nil:
+		v.Null = true
+	case MissingValue:
+		v.Missing = true
+	case []byte:
+		v.Value = append([]byte(nil), src...)
+	default:
+		v.Value = src
+	}
+	return nil
+}
 
-	resultsDecoder := json.NewDecoder(rows.results)
-	err := resultsDecoder.Decode(&resultRows)
+// How much of a response is read, and for how long, when rows are closed
+// early so that the connection can be reused. Longer responses are
+// abandoned.
+var (
+	N1QL_MAX_DRAIN_BYTES int64 = 256 * 1024
+	N1QL_DRAIN_TIMEOUT         = 100 * time.Millisecond
+)
 
-	if err != nil {
-		rows.errChan <- err
+// Rows reading the results from stream. ctx is the context of the caller,
+// cancel that of the request. The caller completes them with the rows read
+// ahead, errors and passthrough values.
+func newRows(stream *resultStream, resp *http.Response, req *n1qlRequest, ctx context.Context, cancel context.CancelFunc, signature interface{}, columns []string, opts rowsOptions) *n1qlRows {
+
+	if columns == nil {
+		columns = []string{"null"}
+	}
+
+	return &n1qlRows{stream: stream,
+		resp:        resp,
+		req:         req,
+		ctx:         ctx,
+		cancel:      cancel,
+		signature:   signature,
+		columns:     columns,
+		rowsOptions: opts,
 	}
+}
 
+// Returns the next row: in passthrough mode first the extras and metrics,
+// then the rows read ahead, the rows still to be read and, in passthrough
+// mode, finally the errors. Then either io.EOF or the errors reported by
+// the server.
+func (rows *n1qlRows) nextRow() (interface{}, error) {
 	if rows.extras != nil {
-		rows.resultChan <- rows.extras
+		r := rows.extras
+		rows.extras = nil
+		return r, nil
 	}
 
 	// second row will be metrics
 	if rows.metrics != nil {
-		rows.resultChan <- rows.metrics
+		r := rows.metrics
+		rows.metrics = nil
+		return r, nil
 	}
 
-	for _, row := range resultRows {
-		if rows.closed == true {
-			break
+	var raw json.RawMessage
+	if len(rows.pending) > 0 {
+		raw = rows.pending[0]
+		rows.pending = rows.pending[1:]
+	} else if !rows.eof {
+		var err error
+		raw, err = rows.stream.next()
+		if err == io.EOF {
+			rows.eof = true
+			requestID := decodeRequestID(rows.stream.field("requestID"))
+			rows.warnings = rows.req.warned(rows.stream.field("warnings"), requestID)
+
+			rows.req.recordResponse(rows.stream.field("metrics"))
+
+			// errors returned along with the results are reported once
+			// the results have been read, except in passthrough mode
+			// where they are the last row
+			if errors := rows.stream.field("errors"); errors != nil && !rows.passthrough {
+				n1qlErrs := decodeErrors(errors, requestID, rows.resp.StatusCode)
+				return nil, fmt.Errorf("N1QL: Error executing query %w", n1qlErrs)
+			}
+		} else if err != nil {
+			err = fmt.Errorf("N1QL: Failed to decode result %v", err)
+
+			// dropping the connection is enough if the rows are being
+			// closed, unless the caller gave up
+			if atomic.LoadInt32(&rows.closing) == 1 && rows.ctx.Err() == nil {
+				return nil, err
+			}
+			return nil, rows.req.failed(err)
 		}
-		rows.resultChan <- row
+	}
+
+	if raw != nil {
+		row, err := decodeRow(raw)
+		if err != nil {
+			return nil, fmt.Errorf("N1QL: Failed to decode row %v", err)
+		}
+		return row, nil
 	}
 
 	if rows.errors != nil {
-		rows.resultChan <- rows.errors
+		r := rows.errors
+		rows.errors = nil
+		return r, nil
+	}
+	return nil, io.EOF
+}
+
+// Release the response. If all of it can be read cheaply, the connection
+// goes back to the pool, otherwise it is dropped.
+func (rows *n1qlRows) finish() {
+	if rows.done {
+		return
 	}
+	rows.done = true
+	rows.pending = nil
 
-	close(rows.resultChan)
+	timer := time.AfterFunc(N1QL_DRAIN_TIMEOUT, rows.cancel)
+	io.Copy(ioutil.Discard, io.LimitReader(rows.resp.Body, N1QL_MAX_DRAIN_BYTES))
+	timer.Stop()
+	rows.resp.Body.Close()
+	rows.req.complete(nil)
 
+	// the outcome of DML is not known unless the response was read
+	rows.req.recordMutations(0, false)
+	rows.cancel()
 }
 
-func (rows *n1qlRows) Columns() []string {
+// The warnings are only read by Next, so they are guarded by the lock
+func (rows *n1qlRows) Warnings() []N1QLWarning {
+	rows.lock.Lock()
+	defer rows.lock.Unlock()
+	return rows.warnings
+}
 
-	var columns = make([]string, 0)
+func (rows *n1qlRows) Metadata() N1QLMetadata {
+	rows.lock.Lock()
+	defer rows.lock.Unlock()
 
+	// the metrics have been decoded already if the response was read
+	md, _ := decodeMetadata(rows.stream.fields, rows.req.clientContextID)
+	md.Warnings = rows.warnings
+	return md
+}
+
+// The columns are in the order of the projection, as given by the signature
+func (rows *n1qlRows) Columns() []string {
+	return rows.columns
+}
+
+// type of the column according to the signature, such as json or number
+func (rows *n1qlRows) columnType(index int) string {
 	switch s := rows.signature.(type) {
 	case map[string]interface{}:
-		for key, _ := range s {
-			columns = append(columns, key)
+		if t, ok := s[rows.columns[index]].(string); ok && t != "*" {
+			return t
 		}
 	case string:
-		columns = append(columns, s)
-	case nil:
-		columns = append(columns, "null")
+		return s
 	}
+	return "json"
+}
+
+func (rows *n1qlRows) ColumnTypeDatabaseTypeName(index int) string {
+	return strings.ToUpper(rows.columnType(index))
+}
+
+var (
+	scanTypeBytes     = reflect.TypeOf([]byte(nil))
+	scanTypeString    = reflect.TypeOf("")
+	scanTypeFloat64   = reflect.TypeOf(float64(0))
+	scanTypeBool      = reflect.TypeOf(false)
+	scanTypeInterface = reflect.TypeOf((*interface{})(nil)).Elem()
+)
+
+// Go type suitable for scanning values of the column into. Numbers may
+// be returned as int64 or float64, and json columns may hold any value.
+func (rows *n1qlRows) ColumnTypeScanType(index int) reflect.Type {
+	if rows.rawJSON == true || rows.passthrough == true {
+		return scanTypeBytes
+	}
+
+	switch rows.columnType(index) {
+	case "string":
+		return scanTypeString
+	case "number":
+		return scanTypeFloat64
+	case "boolean":
+		return scanTypeBool
+	case "object", "array":
+		return scanTypeBytes
+	default:
+		return scanTypeInterface
+	}
+}
 
-	sort.Strings(columns)
-	rows.columns = columns
-	return columns
+// Any value can be NULL or MISSING
+func (rows *n1qlRows) ColumnTypeNullable(index int) (nullable, ok bool) {
+	return true, true
 }
 
 func (rows *n1qlRows) Close() error {
-	rows.closed = true
-	return nil
+	// a call to Next may be waiting on the server, abort it
+	atomic.StoreInt32(&rows.closing, 1)
+	if !rows.lock.TryLock() {
+		rows.cancel()
+		rows.lock.Lock()
+	}
+	defer rows.lock.Unlock()
+
+	// database/sql closes the rows when the caller gives up, the request
+	// has to be cancelled on the server as well unless it was all read
+	var err error
+	if !rows.done && !rows.eof && !rows.passthrough && rows.ctx.Err() != nil {
+		err = rows.req.failed(rows.ctx.Err())
+	}
+
+	rows.finish()
+	return err
 }
 
 func (rows *n1qlRows) Next(dest []driver.Value) error {
-	select {
-	case r, ok := <-rows.resultChan:
-		if ok {
-			numColumns := len(rows.Columns())
-
-			if numColumns == 1 {
-				bytes, _ := json.Marshal(r)
-				dest[0] = bytes
-			} else if rows.passthrough == true && rows.rowsSent < 2 {
-				// first two rows in passthrough mode are status and metrics
-				// in passthrough mode if the query being executed has multiple projections
-				// then it is highly likely that the number of columns of the metrics/status
-				// will not match the number of columns, therefore the following hack
-				bytes, _ := json.Marshal(r)
-				dest[0] = bytes
-				for i := 1; i < numColumns; i++ {
-					dest[i] = ""
+	rows.lock.Lock()
+	defer rows.lock.Unlock()
+
+	if rows.done {
+		return io.EOF
+	}
+
+	r, err := rows.nextRow()
+	if err != nil {
+		rows.finish()
+		return err
+	}
+
+	if rows.rawJSON == true || rows.passthrough == true {
+		err = rows.rawValues(r, dest)
+	} else {
+		err = rows.values(r, dest)
+	}
+	rows.rowsSent++
+	return err
+}
+
+// Set dest to the values of the row. Strings, numbers, booleans and nulls
+// are returned as native values, objects and arrays as JSON.
+func (rows *n1qlRows) values(r interface{}, dest []driver.Value) error {
+	numColumns := len(rows.columns)
+
+	if numColumns == 1 {
+		switch resultRow := r.(type) {
+		case map[string]interface{}:
+			// select * returns the whole document
+			if _, ok := rows.signature.(string); ok || rows.columns[0] == "*" {
+				return jsonValue(r, &dest[0])
+			}
+			if len(resultRow) > numColumns {
+				return fmt.Errorf("N1QL: More Colums than expected %d != %d r %v", len(resultRow), numColumns, r)
+			}
+			if value, exists := resultRow[rows.columns[0]]; exists == true {
+				return jsonValue(value, &dest[0])
+			}
+			dest[0] = rows.missing()
+			return nil
+		default:
+			// select raw returns bare values
+			return jsonValue(r, &dest[0])
+		}
+	}
+
+	switch resultRow := r.(type) {
+	case map[string]interface{}:
+		if len(resultRow) > numColumns {
+			return fmt.Errorf("N1QL: More Colums than expected %d != %d r %v", len(resultRow), numColumns, r)
+		}
+		for i, colName := range rows.columns {
+			if value, exists := resultRow[colName]; exists == true {
+				if err := jsonValue(value, &dest[i]); err != nil {
+					return err
 				}
 			} else {
-				switch resultRow := r.(type) {
-				case map[string]interface{}:
-					if len(resultRow) > numColumns {
-						return fmt.Errorf("N1QL: More Colums than expected %d != %d r %v", len(resultRow), numColumns, r)
-					}
-					i := 0
-					for _, colName := range rows.columns {
-						if value, exists := resultRow[colName]; exists == true {
-							bytes, _ := json.Marshal(value)
-							dest[i] = bytes
-
-						} else {
-							dest[i] = ""
-						}
-						i++
-					}
-				case []interface{}:
-					i := 0
-					for _, value := range resultRow {
-						bytes, _ := json.Marshal(value)
-						dest[i] = bytes
-						i++
-					}
+				dest[i] = rows.missing()
+			}
+		}
+	case []interface{}:
+		for i := range rows.columns {
+			if i >= len(resultRow) {
+				dest[i] = rows.missing()
+			} else if err := jsonValue(resultRow[i], &dest[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// value of MISSING fields
+func (rows *n1qlRows) missing() driver.Value {
+	if rows.reportMissing {
+		return Missing
+	}
+	return nil
+}
+
+// Set dest to the JSON encoding of the values of the row
+func (rows *n1qlRows) rawValues(r interface{}, dest []driver.Value) error {
+	numColumns := len(rows.columns)
+
+	if numColumns == 1 {
+		bytes, _ := json.Marshal(r)
+		dest[0] = bytes
+	} else if rows.passthrough == true && rows.rowsSent < 2 {
+		// first two rows in passthrough mode are status and metrics
+		// in passthrough mode if the query being executed has multiple projections
+		// then it is highly likely that the number of columns of the metrics/status
+		// will not match the number of columns, therefore the following hack
+		bytes, _ := json.Marshal(r)
+		dest[0] = bytes
+		for i := 1; i < numColumns; i++ {
+			dest[i] = ""
+		}
+	} else {
+		switch resultRow := r.(type) {
+		case map[string]interface{}:
+			if len(resultRow) > numColumns {
+				return fmt.Errorf("N1QL: More Colums than expected %d != %d r %v", len(resultRow), numColumns, r)
+			}
+			i := 0
+			for _, colName := range rows.columns {
+				if value, exists := resultRow[colName]; exists == true {
+					bytes, _ := json.Marshal(value)
+					dest[i] = bytes
 
+				} else {
+					dest[i] = ""
 				}
+				i++
 			}
-			rows.rowsSent++
-			return nil
+		case []interface{}:
+			i := 0
+			for _, value := range resultRow {
+				bytes, _ := json.Marshal(value)
+				dest[i] = bytes
+				i++
+			}
+
+		}
+	}
+	return nil
+}
+
+// Convert a decoded JSON value to a driver value. Integers that fit are
+// returned as int64, other numbers as float64.
+func jsonValue(value interface{}, dest *driver.Value) error {
+	switch value := value.(type) {
+	case nil, string, bool:
+		*dest = value
+	case json.Number:
+		if i, err := value.Int64(); err == nil {
+			*dest = i
+		} else if f, err := value.Float64(); err == nil {
+			*dest = f
 		} else {
-			return io.EOF
+			return fmt.Errorf("N1QL: Invalid number %v. Error %v", value, err)
+		}
+	default:
+		bytes, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("N1QL: Failed to marshal value. Error %v", err)
 		}
-	case e := <-rows.errChan:
-		return e
+		*dest = bytes
 	}
+	return nil
 }
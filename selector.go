@@ -0,0 +1,180 @@
+//  Copyright 2014-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package go_n1ql
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// NodeSelector chooses the query node each request is sent to. A selector
+// is shared by all the connections of a connector, so it must be safe for
+// concurrent use.
+type NodeSelector interface {
+	// Select returns one of nodes, the query API URLs of the nodes that
+	// are currently available. nodes is never empty.
+	Select(nodes []string) string
+
+	// Done is called once for every node returned by Select, when the
+	// request sent to it completes. latency is the time the node took to
+	// start responding, err is the error if the node could not be reached.
+	Done(node string, latency time.Duration, err error)
+}
+
+// Latency recorded by the EWMA selector for a node that could not be reached
+var N1QL_EWMA_ERROR_PENALTY = time.Second
+
+// used by connections that have no selector of their own
+var defaultNodeSelector = NewRoundRobinSelector()
+
+type roundRobinSelector struct {
+	next uint32
+}
+
+// NewRoundRobinSelector returns a selector sending requests to each node
+// in turn
+func NewRoundRobinSelector() NodeSelector {
+	return &roundRobinSelector{}
+}
+
+func (s *roundRobinSelector) Select(nodes []string) string {
+	n := atomic.AddUint32(&s.next, 1) - 1
+	return nodes[n%uint32(len(nodes))]
+}
+
+func (s *roundRobinSelector) Done(node string, latency time.Duration, err error) {
+}
+
+type leastOutstandingSelector struct {
+	lock        sync.Mutex
+	next        int
+	outstanding map[string]int
+}
+
+// NewLeastOutstandingSelector returns a selector sending requests to the
+// node with the fewest requests in progress. Nodes with as few requests
+// are taken in turn.
+func NewLeastOutstandingSelector() NodeSelector {
+	return &leastOutstandingSelector{outstanding: make(map[string]int)}
+}
+
+func (s *leastOutstandingSelector) Select(nodes []string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.next++
+	selected := ""
+	for i := range nodes {
+		node := nodes[(s.next+i)%len(nodes)]
+		if selected == "" || s.outstanding[node] < s.outstanding[selected] {
+			selected = node
+		}
+	}
+	s.outstanding[selected]++
+	return selected
+}
+
+func (s *leastOutstandingSelector) Done(node string, latency time.Duration, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.outstanding[node] <= 1 {
+		delete(s.outstanding, node)
+	} else {
+		s.outstanding[node]--
+	}
+}
+
+type ewmaSelector struct {
+	lock        sync.Mutex
+	alpha       float64
+	latency     map[string]float64
+	outstanding map[string]int
+}
+
+// NewEWMASelector returns a selector sending requests to the node with
+// the lowest exponentially weighted moving average of latencies, weighted
+// by the number of requests in progress. alpha is the weight of the latest
+// latency, from 0 to 1, and defaults to 0.3. Nodes are tried at least once
+// before any is preferred.
+func NewEWMASelector(alpha float64) NodeSelector {
+	if alpha <= 0 || alpha > 1 {
+		alpha = 0.3
+	}
+	return &ewmaSelector{alpha: alpha,
+		latency:     make(map[string]float64),
+		outstanding: make(map[string]int),
+	}
+}
+
+func (s *ewmaSelector) Select(nodes []string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	selected := ""
+	var best float64
+	for _, node := range nodes {
+		cost := s.latency[node] * float64(s.outstanding[node]+1)
+		if selected == "" || cost < best ||
+			(cost == best && s.outstanding[node] < s.outstanding[selected]) {
+			selected = node
+			best = cost
+		}
+	}
+	s.outstanding[selected]++
+	return selected
+}
+
+func (s *ewmaSelector) Done(node string, latency time.Duration, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.outstanding[node] <= 1 {
+		delete(s.outstanding, node)
+	} else {
+		s.outstanding[node]--
+	}
+
+	if err != nil {
+		latency = N1QL_EWMA_ERROR_PENALTY
+	}
+	if average, ok := s.latency[node]; ok {
+		s.latency[node] = s.alpha*float64(latency) + (1-s.alpha)*average
+	} else {
+		s.latency[node] = float64(latency)
+	}
+}
+
+type nodeKey struct{}
+
+// WithNode returns a context sending requests made with it to the given
+// query node, bypassing the node selector. node is the host and port of
+// the node, as in "10.0.0.1:8093", or its query API URL. Requests fail if
+// the node is not available rather than going to another node.
+func WithNode(ctx context.Context, node string) context.Context {
+	return context.WithValue(ctx, nodeKey{}, node)
+}
+
+// the node requests made with ctx are pinned to, if any
+func pinnedNode(ctx context.Context) (string, bool) {
+	node, ok := ctx.Value(nodeKey{}).(string)
+	return node, ok
+}
+
+// whether queryAPI is the query API of node
+func isNode(queryAPI, node string) bool {
+	if queryAPI == node {
+		return true
+	}
+	u, err := url.Parse(queryAPI)
+	return err == nil && u.Host == node
+}
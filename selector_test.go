@@ -0,0 +1,112 @@
+//  Copyright 2014-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package go_n1ql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+var testNodes = []string{"http://n1:8093/query/service", "http://n2:8093/query/service", "http://n3:8093/query/service"}
+
+func TestRoundRobinSelector(t *testing.T) {
+	s := NewRoundRobinSelector()
+
+	counts := map[string]int{}
+	for i := 0; i < 30; i++ {
+		node := s.Select(testNodes)
+		s.Done(node, time.Millisecond, nil)
+		counts[node]++
+	}
+
+	for _, node := range testNodes {
+		if counts[node] != 10 {
+			t.Fatalf("Expected 10 requests to %s got %d", node, counts[node])
+		}
+	}
+}
+
+func TestLeastOutstandingSelector(t *testing.T) {
+	s := NewLeastOutstandingSelector()
+
+	// one request to each node, then the next goes to the first to complete
+	busy := map[string]bool{}
+	for range testNodes {
+		busy[s.Select(testNodes)] = true
+	}
+	if len(busy) != len(testNodes) {
+		t.Fatalf("Expected requests to all nodes got %v", busy)
+	}
+
+	s.Done(testNodes[1], time.Millisecond, nil)
+	if node := s.Select(testNodes); node != testNodes[1] {
+		t.Fatalf("Expected %s got %s", testNodes[1], node)
+	}
+}
+
+func TestEWMASelector(t *testing.T) {
+	s := NewEWMASelector(0.5)
+
+	// every node is tried first
+	latencies := map[string]time.Duration{
+		testNodes[0]: 50 * time.Millisecond,
+		testNodes[1]: 5 * time.Millisecond,
+		testNodes[2]: 20 * time.Millisecond,
+	}
+	tried := map[string]bool{}
+	for range testNodes {
+		node := s.Select(testNodes)
+		tried[node] = true
+		s.Done(node, latencies[node], nil)
+	}
+	if len(tried) != len(testNodes) {
+		t.Fatalf("Expected all nodes to be tried got %v", tried)
+	}
+
+	node := s.Select(testNodes)
+	if node != testNodes[1] {
+		t.Fatalf("Expected fastest node %s got %s", testNodes[1], node)
+	}
+
+	// a node that cannot be reached is avoided
+	s.Done(node, 0, errors.New("connection refused"))
+	if node := s.Select(testNodes); node != testNodes[2] {
+		t.Fatalf("Expected %s got %s", testNodes[2], node)
+	}
+}
+
+func TestWithNode(t *testing.T) {
+	srv := fakeQueryService(t, func(r *http.Request) string {
+		return `{"results": [{"$1": 1}], "status": "success"}`
+	})
+	defer srv.Close()
+
+	connector, err := NewConnector(Config{Endpoint: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	u, _ := url.Parse(srv.URL)
+	var one int
+	if err := db.QueryRowContext(WithNode(context.Background(), u.Host), "select 1").Scan(&one); err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.QueryRowContext(WithNode(context.Background(), "10.0.0.1:8093"), "select 1").Scan(&one)
+	if err == nil {
+		t.Fatalf("Expected request to unknown node to fail")
+	}
+}
@@ -0,0 +1,132 @@
+//  Copyright 2014-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package go_n1ql
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Reads a query response as it arrives. The fields preceding the results
+// are read when the stream is created, the results one at a time and the
+// fields following them once the results are exhausted, so that only one
+// row is held in memory at a time.
+type resultStream struct {
+	decoder   *json.Decoder
+	fields    map[string]*json.RawMessage
+	inResults bool
+}
+
+func newResultStream(body io.Reader) (*resultStream, error) {
+	stream := &resultStream{
+		decoder: json.NewDecoder(body),
+		fields:  make(map[string]*json.RawMessage),
+	}
+
+	if err := stream.expectDelim('{'); err != nil {
+		return nil, err
+	}
+	if err := stream.readFields(); err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// read the next token, which must be the given delimiter
+func (stream *resultStream) expectDelim(delim json.Delim) error {
+	t, err := stream.decoder.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := t.(json.Delim); !ok || d != delim {
+		return fmt.Errorf("N1QL: Unexpected token %v in response, expected %v", t, delim)
+	}
+	return nil
+}
+
+// Read the fields of the response object, stopping at the start of the
+// results or at the end of the object.
+func (stream *resultStream) readFields() error {
+	for stream.decoder.More() {
+		t, err := stream.decoder.Token()
+		if err != nil {
+			return err
+		}
+		name, ok := t.(string)
+		if !ok {
+			return fmt.Errorf("N1QL: Unexpected token %v in response", t)
+		}
+
+		if name == "results" {
+			t, err := stream.decoder.Token()
+			if err != nil {
+				return err
+			}
+			if d, ok := t.(json.Delim); ok && d == '[' {
+				stream.inResults = true
+				return nil
+			}
+
+			// null results
+			continue
+		}
+
+		var value *json.RawMessage
+		if err := stream.decoder.Decode(&value); err != nil {
+			return err
+		}
+		stream.fields[name] = value
+	}
+
+	return stream.expectDelim('}')
+}
+
+// Returns the next row, or io.EOF once all the results have been read.
+// The fields following the results are then available.
+func (stream *resultStream) next() (json.RawMessage, error) {
+	if !stream.inResults {
+		return nil, io.EOF
+	}
+
+	if stream.decoder.More() {
+		var row json.RawMessage
+		if err := stream.decoder.Decode(&row); err != nil {
+			return nil, err
+		}
+		return row, nil
+	}
+
+	if err := stream.expectDelim(']'); err != nil {
+		return nil, err
+	}
+	stream.inResults = false
+	if err := stream.readFields(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+// the value of a field of the response, nil if it was not sent or is null
+func (stream *resultStream) field(name string) *json.RawMessage {
+	return stream.fields[name]
+}
+
+// decode a row, keeping numbers as json.Number
+func decodeRow(row json.RawMessage) (interface{}, error) {
+	var value interface{}
+
+	decoder := json.NewDecoder(bytes.NewReader(row))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
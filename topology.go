@@ -0,0 +1,208 @@
+//  Copyright 2014-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package go_n1ql
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/couchbase/go-couchbase"
+)
+
+// Connections to a cluster discover its query nodes again at this interval,
+// adding new nodes, dropping removed ones and re-admitting nodes that
+// failed once they respond again. Zero or negative values disable it.
+// Nodes are given N1QL_NODE_PROBE_TIMEOUT to respond.
+var (
+	N1QL_TOPOLOGY_REFRESH_INTERVAL = 30 * time.Second
+	N1QL_NODE_PROBE_TIMEOUT        = 2 * time.Second
+)
+
+// The query nodes used by the connections of a connector. The nodes are
+// discovered by the first connection, or again by a connection finding
+// that none of them responds, and refreshed in the background while any
+// connection is open.
+type topology struct {
+	lock      sync.RWMutex
+	queryAPIs []string
+
+	// only clusters are discovered again
+	discover func() ([]string, error)
+	probe    func(ctx context.Context, queryAPI string) bool
+
+	refs   int
+	closed chan struct{}
+}
+
+// The query nodes to send requests to, if known. The list is replaced
+// rather than changed, so it can be used without holding the lock.
+func (t *topology) nodes() []string {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.queryAPIs
+}
+
+// Set the nodes discovered by a connection
+func (t *topology) set(queryAPIs []string, clusterAddr string, conn *n1qlConn) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.queryAPIs = queryAPIs
+
+	// probes use the settings of the connection, which are those of all
+	// the connections of the connector
+	t.probe = conn.probeNode
+	t.discover = nil
+	if clusterAddr != "" {
+		httpClient := conn.client
+		t.discover = func() ([]string, error) {
+			client, err := couchbase.Connect(clusterAddr)
+			if err != nil {
+				return nil, err
+			}
+			return poolQueryAPIs(clusterAddr, &client, httpClient)
+		}
+	}
+}
+
+// remove a node that failed from the list of query nodes, unless it is
+// the last one
+func (t *topology) removeNode(queryAPI string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	nodes := make([]string, 0, len(t.queryAPIs))
+	for _, node := range t.queryAPIs {
+		if node != queryAPI {
+			nodes = append(nodes, node)
+		}
+	}
+	if len(nodes) > 0 {
+		t.queryAPIs = nodes
+	}
+}
+
+// A connection uses the nodes. The first one starts refreshing them in the
+// background if they are those of a cluster.
+func (t *topology) acquire(interval time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.refs++
+	if t.refs > 1 || t.discover == nil || interval <= 0 {
+		return
+	}
+
+	closed := make(chan struct{})
+	t.closed = closed
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-closed:
+				return
+			case <-ticker.C:
+				t.refresh()
+			}
+		}
+	}()
+}
+
+// A connection is closed. The refresh stops with the last one.
+func (t *topology) release() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.refs--
+	if t.refs == 0 && t.closed != nil {
+		close(t.closed)
+		t.closed = nil
+	}
+}
+
+// how often the query nodes are discovered again, if at all
+func (conn *n1qlConn) topologyRefreshInterval() time.Duration {
+	if conn.globals || conn.cfg.TopologyRefreshInterval == 0 {
+		return N1QL_TOPOLOGY_REFRESH_INTERVAL
+	}
+	return conn.cfg.TopologyRefreshInterval
+}
+
+// Replace the query nodes with those currently in the cluster. Nodes that
+// are not in use, because they are new or failed earlier, are only added
+// once they respond. The nodes are kept if none can be found.
+func (t *topology) refresh() {
+	t.lock.RLock()
+	discover, probe := t.discover, t.probe
+	current := make(map[string]bool, len(t.queryAPIs))
+	for _, node := range t.queryAPIs {
+		current[node] = true
+	}
+	t.lock.RUnlock()
+
+	if discover == nil {
+		return
+	}
+	discovered, err := discover()
+	if err != nil || len(discovered) == 0 {
+		return
+	}
+
+	// probing is slow, it is done without holding the lock
+	admitted := make(map[string]bool, len(discovered))
+	for _, node := range discovered {
+		if !current[node] && probe(context.Background(), node) {
+			admitted[node] = true
+		}
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	// nodes that failed in the meantime stay out until the next refresh
+	inUse := make(map[string]bool, len(t.queryAPIs))
+	for _, node := range t.queryAPIs {
+		inUse[node] = true
+	}
+
+	nodes := make([]string, 0, len(discovered))
+	for _, node := range discovered {
+		if inUse[node] || admitted[node] {
+			nodes = append(nodes, node)
+		}
+	}
+	if len(nodes) > 0 {
+		t.queryAPIs = nodes
+	}
+}
+
+// whether the query node responds to a query
+func (conn *n1qlConn) probeNode(ctx context.Context, queryAPI string) bool {
+	ctx, cancel := context.WithTimeout(ctx, N1QL_NODE_PROBE_TIMEOUT)
+	defer cancel()
+
+	request, err := conn.prepareRequest(ctx, N1QL_DEFAULT_STATEMENT, queryAPI, nil)
+	if err != nil {
+		return false
+	}
+
+	resp, err := conn.client.Do(request)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, N1QL_MAX_ERROR_BYTES))
+	return resp.StatusCode == 200
+}
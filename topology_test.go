@@ -0,0 +1,140 @@
+//  Copyright 2014-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package go_n1ql
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRefreshTopology(t *testing.T) {
+	handler := func(r *http.Request) string {
+		return `{"results": [{"$1": 1}], "status": "success"}`
+	}
+	srvA := fakeQueryService(t, handler)
+	defer srvA.Close()
+	srvB := fakeQueryService(t, handler)
+	defer srvB.Close()
+	srvC := httptest.NewServer(http.NotFoundHandler())
+	srvC.Close()
+
+	connector, err := NewConnector(Config{Endpoint: srvA.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := connector.Connect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	conn := c.(*n1qlConn)
+
+	nodeA := srvA.URL + N1QL_SERVICE_ENDPOINT
+	nodeB := srvB.URL + N1QL_SERVICE_ENDPOINT
+	nodeC := srvC.URL + N1QL_SERVICE_ENDPOINT
+
+	var discovered []string
+	var discoverErr error
+	conn.topology.discover = func() ([]string, error) {
+		return discovered, discoverErr
+	}
+
+	// the nodes are shared by the connections of the connector
+	c2, err := connector.Connect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	if c2.(*n1qlConn).topology != conn.topology {
+		t.Fatal("Expected connections to share the query nodes")
+	}
+
+	check := func(step string, expected ...string) {
+		if nodes := c2.(*n1qlConn).topology.nodes(); !reflect.DeepEqual(nodes, expected) {
+			t.Fatalf("%s: expected nodes %v got %v", step, expected, nodes)
+		}
+	}
+
+	// new nodes are only added if they respond
+	discovered = []string{nodeA, nodeB, nodeC}
+	conn.topology.refresh()
+	check("new nodes", nodeA, nodeB)
+
+	// a node that failed is re-admitted once it responds
+	conn.topology.removeNode(nodeA)
+	check("failed node", nodeB)
+	conn.topology.refresh()
+	check("re-admitted node", nodeA, nodeB)
+
+	// nodes removed from the cluster are dropped
+	discovered = []string{nodeB}
+	conn.topology.refresh()
+	check("removed node", nodeB)
+
+	// the nodes are kept if the cluster cannot be reached
+	discovered, discoverErr = nil, fmt.Errorf("connection refused")
+	conn.topology.refresh()
+	check("unreachable cluster", nodeB)
+
+	// or if none of its nodes respond
+	discovered, discoverErr = []string{nodeC}, nil
+	conn.topology.refresh()
+	check("no node responding", nodeB)
+}
+
+func TestTopologyWatch(t *testing.T) {
+	var lock sync.Mutex
+	discoveries := 0
+	topology := &topology{queryAPIs: []string{"http://a:8093/query/service"},
+		discover: func() ([]string, error) {
+			lock.Lock()
+			defer lock.Unlock()
+			discoveries++
+			return nil, fmt.Errorf("connection refused")
+		},
+	}
+
+	count := func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return discoveries
+	}
+
+	// the connections share a single refresh
+	for i := 0; i < 4; i++ {
+		topology.acquire(10 * time.Millisecond)
+	}
+	time.Sleep(105 * time.Millisecond)
+	if n := count(); n < 5 || n > 11 {
+		t.Fatalf("Expected about 10 discoveries got %d", n)
+	}
+
+	// which stops with the last connection
+	for i := 0; i < 3; i++ {
+		topology.release()
+	}
+	n := count()
+	time.Sleep(50 * time.Millisecond)
+	if count() == n {
+		t.Fatal("Refresh stopped before the last connection")
+	}
+	topology.release()
+	time.Sleep(20 * time.Millisecond)
+	n = count()
+	time.Sleep(50 * time.Millisecond)
+	if count() != n {
+		t.Fatal("Refresh still running after the last connection")
+	}
+}